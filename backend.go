@@ -0,0 +1,120 @@
+package speedtest
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// names of the built-in backends
+const (
+	NativeBackend   = "native"
+	OoklaCliBackend = "ookla-cli"
+)
+
+// BackendConfig describes the test a Backend is created for
+type BackendConfig struct {
+	InterfaceOp string
+	// Timeout is in seconds, for HTTP requests or for the whole run of an external command
+	Timeout int
+	// IsLatency selects the server by latency instead of distance
+	IsLatency bool
+	// ServerID tests against this server instead of selecting one
+	ServerID string
+	Options  *Options
+
+	// the Ookla CLI a batch detected already, the ookla-cli backend looks for it otherwise
+	speedtestCli *SpeedtestCliInfo
+}
+
+// Backend measures one interface, RunBackend calls SelectServer, Latency, Upload
+// and Download in that order and Close once done. Every step fills its part of
+// report, a backend measuring everything at once may fill it all in SelectServer
+type Backend interface {
+	SelectServer(ctx context.Context, report *SpeedReport) error
+	Latency(ctx context.Context, report *SpeedReport) error
+	Upload(ctx context.Context, report *SpeedReport) error
+	Download(ctx context.Context, report *SpeedReport) error
+	Close() error
+}
+
+// BackendFactory creates a Backend for one test
+type BackendFactory func(cfg BackendConfig) (Backend, error)
+
+var (
+	backendsMu sync.RWMutex
+	backends   = make(map[string]BackendFactory)
+)
+
+func init() {
+	RegisterBackend(NativeBackend, newNativeBackend)
+	RegisterBackend(OoklaCliBackend, newOoklaCliBackend)
+}
+
+// RegisterBackend makes a backend available by name, it panics if the name is already taken
+func RegisterBackend(name string, factory BackendFactory) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	if factory == nil {
+		panic("speedtest: RegisterBackend factory is nil")
+	}
+	if _, dup := backends[name]; dup {
+		panic("speedtest: RegisterBackend called twice for backend " + name)
+	}
+	backends[name] = factory
+}
+
+// Backends returns the sorted names of the registered backends
+func Backends() []string {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewBackend creates the backend registered as name
+func NewBackend(name string, cfg BackendConfig) (Backend, error) {
+	backendsMu.RLock()
+	factory, ok := backends[name]
+	backendsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown speedtest backend %q", name)
+	}
+	return factory(cfg)
+}
+
+// RunBackend runs every step of b and closes it. When ctx is done the
+// partial report is returned together with ctx.Err()
+func RunBackend(ctx context.Context, b Backend) (*SpeedReport, error) {
+	defer b.Close()
+	report := &SpeedReport{}
+	if err := b.SelectServer(ctx, report); err != nil {
+		return nil, err
+	}
+	steps := []func(context.Context, *SpeedReport) error{b.Latency, b.Upload, b.Download}
+	for _, step := range steps {
+		if err := step(ctx, report); err != nil {
+			if ctx.Err() != nil {
+				return report, ctx.Err()
+			}
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// run a complete test with the backend picked by cfg.Options
+func runTest(ctx context.Context, cfg BackendConfig) (*SpeedReport, error) {
+	b, err := NewBackend(cfg.Options.backend(), cfg)
+	if err != nil {
+		return nil, err
+	}
+	report, err := RunBackend(ctx, b)
+	cfg.Options.fillRouting(report)
+	return report, err
+}
@@ -0,0 +1,140 @@
+package speedtest
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// each direction of the backend tests runs this long
+const testTransferDuration = 300 * time.Millisecond
+
+// servedRequest is what a testServer saw of one request
+type servedRequest struct {
+	Method        string
+	Endpoint      string // last element of the path
+	Query         url.Values
+	ContentLength string // of the response, once its header was written
+}
+
+// testServer serves a backend handler under /prefix/ and counts what it moved
+type testServer struct {
+	*httptest.Server
+	// body bytes written to responses and read from requests
+	written, read int64
+
+	mu       sync.Mutex
+	requests []*servedRequest
+}
+
+func newTestServer(t *testing.T, prefix string, h http.Handler) *testServer {
+	s := &testServer{}
+	mux := http.NewServeMux()
+	mux.Handle(prefix, h)
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := &servedRequest{Method: r.Method, Endpoint: path.Base(r.URL.Path), Query: r.URL.Query()}
+		s.mu.Lock()
+		s.requests = append(s.requests, req)
+		s.mu.Unlock()
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{&countingReader{r: r.Body, n: &s.read}, r.Body}
+		cw := &countingResponseWriter{ResponseWriter: w, s: s, req: req}
+		mux.ServeHTTP(cw, r)
+		// an empty response has its header written when the handler returns
+		cw.captureHeader()
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// served returns the method requests to endpoint
+func (s *testServer) served(method, endpoint string) []servedRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var requests []servedRequest
+	for _, req := range s.requests {
+		if req.Method == method && req.Endpoint == endpoint {
+			requests = append(requests, *req)
+		}
+	}
+	return requests
+}
+
+type countingResponseWriter struct {
+	http.ResponseWriter
+	s           *testServer
+	req         *servedRequest
+	wroteHeader bool
+}
+
+func (w *countingResponseWriter) captureHeader() {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.s.mu.Lock()
+		w.req.ContentLength = w.Header().Get("Content-Length")
+		w.s.mu.Unlock()
+	}
+}
+
+func (w *countingResponseWriter) WriteHeader(code int) {
+	w.captureHeader()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *countingResponseWriter) Write(p []byte) (int, error) {
+	w.captureHeader()
+	// counted before the client can see the bytes, taken back when they were not written
+	atomic.AddInt64(&w.s.written, int64(len(p)))
+	n, err := w.ResponseWriter.Write(p)
+	atomic.AddInt64(&w.s.written, int64(n-len(p)))
+	return n, err
+}
+
+// runBackendTest runs the backend of opts for testTransferDuration a direction, with 3 latency probes
+func runBackendTest(t *testing.T, opts *Options) *SpeedReport {
+	t.Helper()
+	opts.Duration = testTransferDuration
+	opts.Pings = 3
+	report, err := runTest(context.Background(), BackendConfig{Timeout: 10, Options: opts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+// checkTransfers checks the bytes and speeds of report against what s moved
+func (s *testServer) checkTransfers(t *testing.T, report *SpeedReport) {
+	t.Helper()
+	// the client can't receive more than was written, nor the server read more than was sent
+	if written := atomic.LoadInt64(&s.written); report.DownloadBytes <= 0 || report.DownloadBytes > written {
+		t.Errorf("download = %d bytes, the server wrote %d", report.DownloadBytes, written)
+	}
+	if read := atomic.LoadInt64(&s.read); read <= 0 || read > report.UploadBytes {
+		t.Errorf("upload = %d bytes, the server read %d", report.UploadBytes, read)
+	}
+	checkSpeed(t, "download", report.DownloadSpeed, report.DownloadBytes)
+	checkSpeed(t, "upload", report.UploadSpeed, report.UploadBytes)
+}
+
+// checkSpeed checks that speed is bytes moved in about testTransferDuration
+func checkSpeed(t *testing.T, direction string, speed float64, bytes int64) {
+	t.Helper()
+	if speed <= 0 {
+		t.Errorf("%s speed = %.2f Mbit/s", direction, speed)
+		return
+	}
+	elapsed := time.Duration(float64(bytes) * 8 / 1000 / 1000 / speed * float64(time.Second))
+	// a server timing the transfer, as the ndt7 handler does, starts its clock a little earlier
+	if elapsed < testTransferDuration*9/10 || elapsed > testTransferDuration+time.Second {
+		t.Errorf("%s: %d bytes at %.2f Mbit/s take %v, want about %v", direction, bytes, speed, elapsed, testTransferDuration)
+	}
+}
@@ -0,0 +1,137 @@
+package speedtest
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const CloudflareBackend = "cloudflare"
+
+// Cloudflare's speed test, serving __down and __up
+const cloudflareUrl = "https://speed.cloudflare.com"
+
+const (
+	// each direction runs this long when Options.Duration is not set
+	defaultCloudflareDuration = 10 * time.Second
+	// bytes asked per download request and posted per upload request
+	cloudflareDownloadBytes = 25 * 1000 * 1000
+	cloudflareUploadBytes   = 10 * 1000 * 1000
+)
+
+func init() {
+	RegisterBackend(CloudflareBackend, newCloudflareBackend)
+}
+
+// cloudflareBackend measures with the __down?bytes=N and __up endpoints of
+// Options.CloudflareURL, latency is the time to the headers of an empty __down
+type cloudflareBackend struct {
+	cfg     BackendConfig
+	session *httpUtil
+	base    string
+	server  string
+}
+
+func newCloudflareBackend(cfg BackendConfig) (Backend, error) {
+	return &cloudflareBackend{cfg: cfg}, nil
+}
+
+func (b *cloudflareBackend) SelectServer(ctx context.Context, report *SpeedReport) error {
+	opts := b.cfg.Options
+	opts.progress(Progress{Phase: PhaseServerSelection, NetInterface: b.cfg.InterfaceOp})
+	session, err := getHttpUtil(b.cfg.InterfaceOp, b.cfg.Timeout, opts)
+	if err != nil {
+		return err
+	}
+	b.session = session
+	b.base = cloudflareUrl
+	if opts != nil && opts.CloudflareURL != "" {
+		b.base = strings.TrimSuffix(opts.CloudflareURL, "/")
+	}
+	baseURL, err := url.Parse(b.base)
+	if err != nil {
+		return err
+	}
+	b.server = baseURL.Host
+
+	// the cf-meta headers of an empty download tell which data center answers and who we are
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.downURL(0), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := session.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if err := checkStatus(resp); err != nil {
+		return err
+	}
+	report.SpeedtestServer.ID = b.server
+	report.SpeedtestServer.Name = b.server
+	if colo := resp.Header.Get("cf-meta-colo"); colo != "" {
+		report.SpeedtestServer.ID = colo
+		report.SpeedtestServer.Name = colo
+	}
+	report.SpeedtestServer.Host = b.server
+	report.SpeedtestServer.Location = resp.Header.Get("cf-meta-city")
+	report.SpeedtestServer.Sponsor = "Cloudflare"
+	report.NetInterface.Name = b.cfg.InterfaceOp
+	report.NetInterface.InternalIp = session.Interface.InternalIp
+	report.NetInterface.Family = ipFamily(session.Interface.InternalIp, opts.family())
+	report.NetInterface.ExternalIp = resp.Header.Get("cf-meta-ip")
+	return nil
+}
+
+func (b *cloudflareBackend) downURL(bytes int) string {
+	return b.base + "/__down?bytes=" + strconv.Itoa(bytes)
+}
+
+func (b *cloudflareBackend) Latency(ctx context.Context, report *SpeedReport) error {
+	opts := b.cfg.Options
+	opts.progress(Progress{Phase: PhaseLatency, NetInterface: b.cfg.InterfaceOp, Server: b.server})
+	stats, err := pingStats(ctx, b.session.Client, b.downURL(0), opts.pings())
+	if err != nil {
+		return err
+	}
+	report.LatencyStats = stats
+	report.Latency = stats.Min
+	return nil
+}
+
+func (b *cloudflareBackend) Upload(ctx context.Context, report *SpeedReport) (err error) {
+	opts := b.cfg.Options
+	upURL := b.base + "/__up"
+	p := Progress{Phase: PhaseUpload, NetInterface: b.cfg.InterfaceOp, Server: b.server}
+	report.UploadSpeed, report.UploadBytes, err = opts.runFor(ctx, p, b.duration(), opts.streams(), func(runCtx context.Context, sent *int64) error {
+		return upload(runCtx, b.session.Client, upURL, binaryContentType, newRandomPayload(cloudflareUploadBytes), sent)
+	})
+	return err
+}
+
+func (b *cloudflareBackend) Download(ctx context.Context, report *SpeedReport) (err error) {
+	opts := b.cfg.Options
+	downURL := b.downURL(cloudflareDownloadBytes)
+	p := Progress{Phase: PhaseDownload, NetInterface: b.cfg.InterfaceOp, Server: b.server}
+	report.DownloadSpeed, report.DownloadBytes, err = opts.runFor(ctx, p, b.duration(), opts.streams(), func(runCtx context.Context, received *int64) error {
+		return download(runCtx, b.session.Client, downURL, received)
+	})
+	return err
+}
+
+func (b *cloudflareBackend) duration() time.Duration {
+	if d := b.cfg.Options.duration(); d > 0 {
+		return d
+	}
+	return defaultCloudflareDuration
+}
+
+func (b *cloudflareBackend) Close() error {
+	if b.session != nil {
+		b.session.Client.CloseIdleConnections()
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package speedtest
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+)
+
+// biggest __down served by CloudflareHandler
+const maxCloudflareBytes = 100 * 1000 * 1000
+
+// CloudflareHandler serves the __down?bytes=N and __up endpoints of Cloudflare's
+// speed test. Endpoints are matched on the last path element, so the handler can
+// be mounted under any prefix
+type CloudflareHandler struct {
+	// Colo is announced in the cf-meta-colo header, City in cf-meta-city
+	Colo string
+	City string
+}
+
+func (h *CloudflareHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ip = host
+	}
+	w.Header().Set("cf-meta-ip", ip)
+	if h.Colo != "" {
+		w.Header().Set("cf-meta-colo", h.Colo)
+	}
+	if h.City != "" {
+		w.Header().Set("cf-meta-city", h.City)
+	}
+	switch path.Base(r.URL.Path) {
+	case "__down":
+		h.serveDown(w, r)
+	case "__up":
+		io.Copy(ioutil.Discard, r.Body)
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *CloudflareHandler) serveDown(w http.ResponseWriter, r *http.Request) {
+	var bytes int64
+	if value := r.URL.Query().Get("bytes"); value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 || n > maxCloudflareBytes {
+			http.Error(w, "bad bytes", http.StatusBadRequest)
+			return
+		}
+		bytes = n
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(bytes, 10))
+	if r.Method == http.MethodHead {
+		return
+	}
+	io.Copy(w, newRandomPayload(bytes))
+}
@@ -0,0 +1,93 @@
+package speedtest
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCloudflareHandler(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/cf/", &CloudflareHandler{Colo: "AMS", City: "Amsterdam"})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/cf/__down?bytes=12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || len(body) != 12345 {
+		t.Errorf("__down?bytes=12345 = %d bytes, %v", len(body), err)
+	}
+	if h := resp.Header; h.Get("cf-meta-colo") != "AMS" || h.Get("cf-meta-city") != "Amsterdam" || h.Get("cf-meta-ip") != "127.0.0.1" {
+		t.Errorf("cf-meta headers = %v", h)
+	}
+
+	for _, bytes := range []string{"x", "-1", strconv.Itoa(maxCloudflareBytes + 1)} {
+		resp, err := http.Get(ts.URL + "/cf/__down?bytes=" + bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("__down?bytes=%s = %s, want 400", bytes, resp.Status)
+		}
+	}
+
+	resp, err = http.Post(ts.URL+"/cf/__up", "text/plain", strings.NewReader(strings.Repeat("x", 1<<16)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("__up = %s, want 200", resp.Status)
+	}
+
+	resp, err = http.Get(ts.URL + "/cf/other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown path = %s, want 404", resp.Status)
+	}
+}
+
+func TestCloudflareBackend(t *testing.T) {
+	s := newTestServer(t, "/cf/", &CloudflareHandler{Colo: "AMS", City: "Amsterdam"})
+	report := runBackendTest(t, &Options{Backend: CloudflareBackend, CloudflareURL: s.URL + "/cf/"})
+	s.checkTransfers(t, report)
+	if s := report.SpeedtestServer; s.ID != "AMS" || s.Location != "Amsterdam" || s.Sponsor != "Cloudflare" {
+		t.Errorf("server = %+v, want the handler's colo", s)
+	}
+	if report.NetInterface.ExternalIp != "127.0.0.1" {
+		t.Errorf("external ip = %q, want the cf-meta-ip one", report.NetInterface.ExternalIp)
+	}
+	// __down?bytes=0 answers the server selection, opens the ping connection and
+	// times the 3 probes, the transfers ask for cloudflareDownloadBytes each
+	var empty, transfers int
+	for _, req := range s.served(http.MethodGet, "__down") {
+		switch bytes := req.Query.Get("bytes"); {
+		case bytes == "0" && req.ContentLength == "0":
+			empty++
+		case bytes == "25000000" && req.ContentLength == "25000000":
+			transfers++
+		default:
+			t.Errorf("__down?bytes=%s answered Content-Length %s", bytes, req.ContentLength)
+		}
+	}
+	if empty != 5 || transfers == 0 {
+		t.Errorf("%d empty and %d sized __down requests, want 5 and some", empty, transfers)
+	}
+	if report.LatencyStats == nil || report.LatencyStats.Probes != 3 {
+		t.Errorf("latency stats = %+v, want 3 probes", report.LatencyStats)
+	}
+	if len(s.served(http.MethodPost, "__up")) == 0 {
+		t.Error("nothing posted to __up")
+	}
+}
@@ -1,6 +1,8 @@
 package speedtest
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"strings"
 	"time"
@@ -9,29 +11,92 @@ import (
 )
 
 func ExecCmd(_cmd string, timeout int, args ...string) (stdOut, stdErr string, err error) {
+	return ExecCmdContext(context.Background(), _cmd, timeout, args...)
+}
+
+// ExecCmdContext is like ExecCmd but also stops the command when ctx is done
+func ExecCmdContext(ctx context.Context, _cmd string, timeout int, args ...string) (stdOut, stdErr string, err error) {
 	findcmd := cmd.NewCmd(_cmd, args...)
 	statusChan := findcmd.Start()
 	if timeout == 0 {
 		timeout = 15
 	}
 	ticker := time.NewTicker(time.Duration(timeout) * time.Second)
+	defer ticker.Stop()
 	go func() {
 		select {
 		case <-findcmd.Done():
 		case <-ticker.C:
 			findcmd.Stop()
+		case <-ctx.Done():
+			findcmd.Stop()
 		}
 	}()
 	finalStatus := <-statusChan
 	stdErr = strings.Join(finalStatus.Stderr, "\n")
 	stdOut = strings.Join(finalStatus.Stdout, "\n")
-	if finalStatus.Exit != 0 {
-		errstr := fmt.Sprintf("exit code:%d", finalStatus.Exit)
-		if finalStatus.Error != nil {
-			errstr += fmt.Sprintf(" errmsg:%s", finalStatus.Error.Error())
+	if ctx.Err() != nil {
+		return stdOut, stdErr, ctx.Err()
+	}
+	return stdOut, stdErr, exitError(finalStatus)
+}
+
+// longest line ExecCmdStream hands over, a longer one fails the command
+const streamLineBufferSize = 1 << 20
+
+// ExecCmdStream is like ExecCmdContext but hands every line of stdout to onLine
+// as soon as it is printed, onLine is called from a single goroutine
+func ExecCmdStream(ctx context.Context, _cmd string, timeout int, onLine func(line string), args ...string) (stdErr string, err error) {
+	findcmd := cmd.NewCmdOptions(cmd.Options{Streaming: true, LineBufferSize: streamLineBufferSize}, _cmd, args...)
+	statusChan := findcmd.Start()
+	if timeout == 0 {
+		timeout = 15
+	}
+	ticker := time.NewTicker(time.Duration(timeout) * time.Second)
+	defer ticker.Stop()
+	go func() {
+		select {
+		case <-findcmd.Done():
+		case <-ticker.C:
+			findcmd.Stop()
+		case <-ctx.Done():
+			findcmd.Stop()
 		}
-		return stdOut, stdErr, fmt.Errorf(errstr)
+	}()
+	// both channels must be drained, they are closed once the command stopped
+	var stdErrLines []string
+	stdout, stderr := findcmd.Stdout, findcmd.Stderr
+	for stdout != nil || stderr != nil {
+		select {
+		case line, ok := <-stdout:
+			if !ok {
+				stdout = nil
+				continue
+			}
+			onLine(line)
+		case line, ok := <-stderr:
+			if !ok {
+				stderr = nil
+				continue
+			}
+			stdErrLines = append(stdErrLines, line)
+		}
+	}
+	finalStatus := <-statusChan
+	stdErr = strings.Join(stdErrLines, "\n")
+	if ctx.Err() != nil {
+		return stdErr, ctx.Err()
 	}
-	return stdOut, stdErr, nil
+	return stdErr, exitError(finalStatus)
+}
 
+func exitError(status cmd.Status) error {
+	if status.Exit == 0 {
+		return nil
+	}
+	errstr := fmt.Sprintf("exit code:%d", status.Exit)
+	if status.Error != nil {
+		errstr += fmt.Sprintf(" errmsg:%s", status.Error.Error())
+	}
+	return errors.New(errstr)
 }
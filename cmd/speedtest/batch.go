@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/Cocoon-break/speedtest"
+)
+
+func batch(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("batch", flag.ExitOnError)
+	var tf testFlags
+	tf.register(fs)
+	interfaces := fs.String("i", "", "comma separated interface names or source IPs")
+	marks := fs.String("marks", "", "comma separated firewall marks, each tested in turn on -i or the default route")
+	mode := fs.String("mode", "onebyone", "onebyone, concurrent or cli")
+	testNum := fs.Int("n", 3, "onebyone: number of servers tried per interface, the fastest result is kept")
+	fs.Parse(args)
+
+	interfaceOps := splitList(*interfaces)
+	if *marks != "" {
+		return batchMarks(ctx, interfaceOps, splitList(*marks), tf)
+	}
+	if len(interfaceOps) == 0 {
+		return errors.New("-i is required")
+	}
+	if *mode == "cli" {
+		return batchCli(ctx, interfaceOps, tf)
+	}
+	isLatency, err := tf.isLatency()
+	if err != nil {
+		return err
+	}
+	opts, err := tf.options()
+	if err != nil {
+		return err
+	}
+	var report *speedtest.BatchReport
+	switch *mode {
+	case "onebyone":
+		report, err = speedtest.OnebyOneWithOptions(ctx, interfaceOps, tf.timeout, isLatency, *testNum, opts)
+	case "concurrent":
+		report, err = speedtest.ConcurrentWithOptions(ctx, interfaceOps, tf.timeout, isLatency, opts)
+	default:
+		return fmt.Errorf("-mode must be onebyone, concurrent or cli, got %q", *mode)
+	}
+	if report == nil {
+		return err
+	}
+	return printBatchReport(report, tf.jsonOut, err)
+}
+
+// test through the Ookla CLI, the timeout applies to each run of the binary
+func batchCli(ctx context.Context, interfaceOps []string, tf testFlags) error {
+	opts, err := tf.options()
+	if err != nil {
+		return err
+	}
+	report, err := speedtest.BySpeedtestCliWithOptions(ctx, interfaceOps, tf.timeout, opts)
+	return printBatchReport(&report, tf.jsonOut, err)
+}
+
+// test one routing policy after the other, -i names at most one interface here
+func batchMarks(ctx context.Context, interfaceOps []string, markList []string, tf testFlags) error {
+	if len(interfaceOps) > 1 {
+		return errors.New("-marks takes at most one interface in -i")
+	}
+	var interfaceOp string
+	if len(interfaceOps) == 1 {
+		interfaceOp = interfaceOps[0]
+	}
+	marks := make([]uint32, 0, len(markList))
+	for _, s := range markList {
+		mark, err := parseMark(s)
+		if err != nil {
+			return fmt.Errorf("-marks: %w", err)
+		}
+		marks = append(marks, mark)
+	}
+	isLatency, err := tf.isLatency()
+	if err != nil {
+		return err
+	}
+	opts, err := tf.options()
+	if err != nil {
+		return err
+	}
+	report, err := speedtest.ByMarks(ctx, interfaceOp, tf.timeout, isLatency, marks, opts)
+	if report == nil {
+		return err
+	}
+	return printBatchReport(report, tf.jsonOut, err)
+}
+
+func printBatchReport(report *speedtest.BatchReport, jsonOut bool, err error) error {
+	if jsonOut {
+		if err := printJSON(report); err != nil {
+			return err
+		}
+	} else {
+		printBatch(os.Stdout, report)
+	}
+	return err
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Cocoon-break/speedtest"
+)
+
+// flags shared by the commands that run tests
+type testFlags struct {
+	timeout    int
+	by         string
+	jsonOut    bool
+	progress   bool
+	configURL  string
+	serversURL string
+	family     string
+	duration   time.Duration
+	streams    int
+	pings      int
+	fresh      bool
+	backend    string
+	libreURL   string
+	iperf3     string
+	iperf3UDP  bool
+	iperf3Rate string
+	ndt7URL    string
+	transport  string
+	cliPath    string
+	cliHost    string
+	cfURL      string
+	mark       string
+	netns      string
+}
+
+func (f *testFlags) register(fs *flag.FlagSet) {
+	f.registerConnection(fs)
+	fs.StringVar(&f.by, "by", "latency", "server selection: latency or distance")
+	fs.StringVar(&f.configURL, "config-url", "", "speedtest-config.php replacement")
+	fs.StringVar(&f.serversURL, "servers-url", "", "speedtest-servers-static.php replacement")
+	fs.StringVar(&f.transport, "transport", "http", "native backend protocol: http or tcp (Ookla TCP protocol on the server host)")
+	fs.IntVar(&f.pings, "pings", 0, "latency probes sent to the tested server")
+	fs.StringVar(&f.libreURL, "librespeed-servers-url", "", "LibreSpeed server list replacement")
+	fs.StringVar(&f.iperf3, "iperf3-servers", "", "comma separated host[:port] targets of the iperf3 backend")
+	fs.BoolVar(&f.iperf3UDP, "iperf3-udp", false, "iperf3 backend: test with UDP")
+	fs.StringVar(&f.iperf3Rate, "iperf3-bandwidth", "", "iperf3 backend: target bandwidth, e.g. 100M")
+	fs.StringVar(&f.ndt7URL, "ndt7-url", "", "ndt7 backend: ws:// or wss:// server instead of the nearest M-Lab one")
+	fs.StringVar(&f.cfURL, "cloudflare-url", "", "cloudflare backend: base URL of __down and __up")
+	fs.StringVar(&f.cliPath, "speedtest-cli-path", "", "Ookla CLI binary, speedtest on PATH by default")
+	fs.StringVar(&f.cliHost, "speedtest-cli-host", "", "Ookla CLI: test against this server host name")
+	fs.StringVar(&f.backend, "backend", speedtest.NativeBackend, "test backend: "+strings.Join(speedtest.Backends(), ", "))
+}
+
+// registerConnection adds the flags of how a test connects and reports,
+// those that don't depend on a backend or a server list
+func (f *testFlags) registerConnection(fs *flag.FlagSet) {
+	fs.IntVar(&f.timeout, "timeout", 60, "http timeout in seconds")
+	fs.BoolVar(&f.jsonOut, "json", false, "print the result as JSON")
+	fs.BoolVar(&f.progress, "progress", false, "print progress to stderr")
+	fs.StringVar(&f.family, "family", "any", "address family: any, 4 or 6")
+	fs.StringVar(&f.mark, "mark", "", "firewall mark (SO_MARK) set on every socket, e.g. 0x1, linux only")
+	fs.StringVar(&f.netns, "netns", "", "run the test inside this network namespace of /var/run/netns, linux only")
+	fs.DurationVar(&f.duration, "duration", 0, "run each direction for this long instead of a fixed workload")
+	fs.IntVar(&f.streams, "streams", 0, "parallel streams of a -duration test")
+	fs.BoolVar(&f.fresh, "fresh-connections", false, "open a new connection for every request")
+}
+
+func (f *testFlags) isLatency() (bool, error) {
+	switch f.by {
+	case "latency":
+		return true, nil
+	case "distance":
+		return false, nil
+	}
+	return false, fmt.Errorf("-by must be latency or distance, got %q", f.by)
+}
+
+func (f *testFlags) options() (*speedtest.Options, error) {
+	opts := &speedtest.Options{
+		Backend:              f.backend,
+		ConfigURL:            f.configURL,
+		ServersURL:           f.serversURL,
+		LibreSpeedServersURL: f.libreURL,
+		Iperf3Servers:        splitList(f.iperf3),
+		Iperf3UDP:            f.iperf3UDP,
+		Iperf3Bandwidth:      f.iperf3Rate,
+		Ndt7URL:              f.ndt7URL,
+		CloudflareURL:        f.cfURL,
+		SpeedtestCliPath:     f.cliPath,
+		SpeedtestCliHost:     f.cliHost,
+		Duration:             f.duration,
+		Streams:              f.streams,
+		Pings:                f.pings,
+		FreshConnections:     f.fresh,
+		Netns:                f.netns,
+	}
+	switch f.family {
+	case "any", "":
+		opts.Family = speedtest.FamilyAny
+	case "4", "ipv4":
+		opts.Family = speedtest.FamilyV4
+	case "6", "ipv6":
+		opts.Family = speedtest.FamilyV6
+	default:
+		return nil, fmt.Errorf("-family must be any, 4 or 6, got %q", f.family)
+	}
+	switch f.transport {
+	case "http", "":
+		opts.Transport = speedtest.TransportHTTP
+	case "tcp":
+		opts.Transport = speedtest.TransportTCP
+	default:
+		return nil, fmt.Errorf("-transport must be http or tcp, got %q", f.transport)
+	}
+	if f.mark != "" {
+		mark, err := parseMark(f.mark)
+		if err != nil {
+			return nil, fmt.Errorf("-mark: %w", err)
+		}
+		opts.Mark = mark
+	}
+	if f.progress {
+		opts.Progress = printProgress
+	}
+	return opts, nil
+}
+
+func printProgress(p speedtest.Progress) {
+	prefix := p.NetInterface
+	if prefix == "" {
+		prefix = "default"
+	}
+	if p.Phase != speedtest.PhaseDownload && p.Phase != speedtest.PhaseUpload || p.Elapsed == 0 {
+		fmt.Fprintf(os.Stderr, "[%s] %s\n", prefix, strings.Replace(string(p.Phase), "_", " ", -1))
+		return
+	}
+	fmt.Fprintf(os.Stderr, "[%s] %s %8.2f Mbit/s %10d bytes %6.1fs\n", prefix, p.Phase, p.Speed, p.Bytes, p.Elapsed.Seconds())
+}
+
+// parseMark accepts decimal, 0x hex and 0 octal marks like iptables does
+func parseMark(s string) (uint32, error) {
+	mark, err := strconv.ParseUint(s, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid mark %q", s)
+	}
+	return uint32(mark), nil
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Cocoon-break/speedtest"
+)
+
+// server list entry printed by list
+type listedServer struct {
+	ID       string        `json:"id"`
+	Name     string        `json:"name"`
+	Sponsor  string        `json:"sponsor"`
+	Country  string        `json:"country"`
+	URL      string        `json:"url"`
+	Distance float64       `json:"distance"`
+	Latency  time.Duration `json:"latency,omitempty"`
+}
+
+func list(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	var tf testFlags
+	tf.register(fs)
+	interfaceOp := fs.String("i", "", "interface name or source IP, empty uses the default route")
+	limit := fs.Int("n", 20, "number of servers to print, 0 prints all")
+	fs.Parse(args)
+
+	isLatency, err := tf.isLatency()
+	if err != nil {
+		return err
+	}
+	opts, err := tf.options()
+	if err != nil {
+		return err
+	}
+	st, err := speedtest.NewSTClient(ctx, *interfaceOp, tf.timeout, opts)
+	if err != nil {
+		return err
+	}
+	servers, err := st.FetchServerListContext(ctx)
+	if err != nil {
+		return err
+	}
+	// distances are printed in both orders
+	servers, err = st.ServerListByDistance(servers)
+	if err != nil {
+		return err
+	}
+	if isLatency {
+		servers, err = st.ServerListByLatencyContext(ctx, servers)
+		if err != nil {
+			return err
+		}
+	}
+	if *limit > 0 && len(servers) > *limit {
+		servers = servers[:*limit]
+	}
+	listed := make([]listedServer, 0, len(servers))
+	for _, s := range servers {
+		l := listedServer{
+			ID:       s.ID,
+			Name:     s.Name,
+			Sponsor:  s.Sponsor,
+			Country:  s.Country,
+			URL:      s.URL,
+			Distance: s.Distance,
+		}
+		if isLatency {
+			l.Latency = s.Latency
+		}
+		listed = append(listed, l)
+	}
+	if tf.jsonOut {
+		return printJSON(listed)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSPONSOR\tNAME\tCOUNTRY\tDISTANCE\tLATENCY")
+	for _, l := range listed {
+		latency := "-"
+		if isLatency {
+			latency = l.Latency.String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%.1f km\t%s\n", l.ID, l.Sponsor, l.Name, l.Country, l.Distance, latency)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,55 @@
+// Command speedtest wraps the speedtest package
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+const usage = `usage: speedtest <command> [flags]
+
+commands:
+  run      test one interface against the nearest or fastest server, a server id or the Ookla CLI
+  list     list the available servers
+  batch    test several interfaces
+  url      measure the throughput to any HTTP URL
+  serve    run an Ookla and LibreSpeed compatible HTTP test server
+
+run "speedtest <command> -h" for the flags of a command
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var err error
+	switch os.Args[1] {
+	case "run":
+		err = run(ctx, os.Args[2:])
+	case "list":
+		err = list(ctx, os.Args[2:])
+	case "batch":
+		err = batch(ctx, os.Args[2:])
+	case "url":
+		err = urlTest(ctx, os.Args[2:])
+	case "serve":
+		err = serve(ctx, os.Args[2:])
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "speedtest %s: %s\n", os.Args[1], err.Error())
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/Cocoon-break/speedtest"
+)
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func printReport(w io.Writer, report *speedtest.SpeedReport) {
+	name := report.NetInterface.Name
+	if name == "" {
+		name = "default"
+	}
+	fmt.Fprintf(w, "Interface: %s %s %s\n", name, report.NetInterface.InternalIp, report.NetInterface.Family)
+	if report.NetInterface.Netns != "" {
+		fmt.Fprintf(w, "Netns:     %s\n", report.NetInterface.Netns)
+	}
+	if report.NetInterface.Mark != 0 {
+		fmt.Fprintf(w, "Mark:      %#x\n", report.NetInterface.Mark)
+	}
+	server := report.SpeedtestServer
+	fmt.Fprintf(w, "Server:    %s (%s, %s) id %s\n", server.Sponsor, server.Name, server.Country, server.ID)
+	fmt.Fprintf(w, "Latency:   %v\n", report.Latency)
+	if stats := report.LatencyStats; stats != nil {
+		fmt.Fprintf(w, "           avg %v median %v max %v jitter %v, %d/%d probes failed\n",
+			stats.Avg, stats.Median, stats.Max, stats.Jitter, stats.Failed, stats.Probes)
+	}
+	fmt.Fprintf(w, "Download:  %.2f Mbit/s (%d bytes)\n", report.DownloadSpeed, report.DownloadBytes)
+	fmt.Fprintf(w, "Upload:    %.2f Mbit/s (%d bytes)\n", report.UploadSpeed, report.UploadBytes)
+	if report.Jitter > 0 || report.PacketLoss > 0 {
+		fmt.Fprintf(w, "Jitter:    %v, packet loss %.2f%%\n", report.Jitter, report.PacketLoss)
+	}
+	if report.Isp != "" {
+		fmt.Fprintf(w, "ISP:       %s %s\n", report.Isp, report.NetInterface.ExternalIp)
+	}
+	if report.ResultURL != "" {
+		fmt.Fprintf(w, "Result:    %s\n", report.ResultURL)
+	}
+}
+
+func printBatch(w io.Writer, batch *speedtest.BatchReport) {
+	for i, report := range batch.SuccessNet {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		printReport(w, report)
+	}
+	for _, report := range batch.PartialNet {
+		fmt.Fprintf(w, "\nPartial:   %s\n", report.Error)
+		printReport(w, report)
+	}
+	if len(batch.FailedNet) > 0 {
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw)
+		for _, name := range batch.FailedNet {
+			fmt.Fprintf(tw, "Failed:\t%s\n", name)
+		}
+		tw.Flush()
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+
+	"github.com/Cocoon-break/speedtest"
+)
+
+func run(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	var tf testFlags
+	tf.register(fs)
+	interfaceOp := fs.String("i", "", "interface name or source IP, empty uses the default route")
+	serverID := fs.String("server", "", "test against this server id instead of selecting one")
+	cli := fs.Bool("cli", false, "run the installed Ookla speedtest CLI instead")
+	fs.Parse(args)
+
+	isLatency, err := tf.isLatency()
+	if err != nil {
+		return err
+	}
+	opts, err := tf.options()
+	if err != nil {
+		return err
+	}
+	if *cli {
+		opts.Backend = speedtest.OoklaCliBackend
+	}
+	var report *speedtest.SpeedReport
+	switch {
+	case *serverID != "":
+		report, err = speedtest.ByServerIDWithOptions(ctx, *interfaceOp, tf.timeout, *serverID, opts)
+	case isLatency:
+		report, err = speedtest.ByLatencyWithOptions(ctx, *interfaceOp, tf.timeout, opts)
+	default:
+		report, err = speedtest.ByDistanceWithOptions(ctx, *interfaceOp, tf.timeout, opts)
+	}
+	if report == nil {
+		return err
+	}
+	if tf.jsonOut {
+		if err := printJSON(report); err != nil {
+			return err
+		}
+	} else {
+		printReport(os.Stdout, report)
+	}
+	return err
+}
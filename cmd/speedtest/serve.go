@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/Cocoon-break/speedtest"
+)
+
+// serve runs until ctx is done, main cancels it on SIGINT and SIGTERM
+func serve(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := fs.String("listen", ":8080", "address to listen on")
+	id := fs.String("id", "1", "server id announced in the server list")
+	name := fs.String("name", "local", "server name announced in the server list")
+	country := fs.String("country", "", "server country announced in the server list")
+	sponsor := fs.String("sponsor", "", "server sponsor announced in the server list")
+	lat := fs.Float64("lat", 0, "server latitude")
+	lon := fs.Float64("lon", 0, "server longitude")
+	tcpListen := fs.String("tcp-listen", "", "also serve the Ookla TCP protocol on this address, announced as the server host")
+	fs.Parse(args)
+
+	handler := &speedtest.Handler{
+		ID:      *id,
+		Name:    *name,
+		Country: *country,
+		Sponsor: *sponsor,
+		Lat:     *lat,
+		Lon:     *lon,
+		Host:    *tcpListen,
+	}
+	if *tcpListen != "" {
+		l, err := net.Listen("tcp", *tcpListen)
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+		log.Printf("serving the Ookla TCP protocol on %s", *tcpListen)
+		go (&speedtest.TCPServer{}).Serve(l)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", handler)
+	mux.Handle("/librespeed/", &speedtest.LibreSpeedHandler{
+		Name:    *name,
+		Sponsor: *sponsor,
+	})
+	mux.Handle("/ndt/v7/", &speedtest.Ndt7Handler{})
+	cloudflare := &speedtest.CloudflareHandler{Colo: *name}
+	mux.Handle("/__down", cloudflare)
+	mux.Handle("/__up", cloudflare)
+	log.Printf("serving speedtest on %s, LibreSpeed server list at /librespeed/servers.json, ndt7 at /ndt/v7/, __down and __up", *listen)
+	srv := &http.Server{Addr: *listen, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/Cocoon-break/speedtest"
+)
+
+func urlTest(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("url", flag.ExitOnError)
+	// ByURL has no backend or server list, only the connection flags apply
+	var tf testFlags
+	tf.registerConnection(fs)
+	interfaceOp := fs.String("i", "", "interface name or source IP, empty uses the default route")
+	uploadURL := fs.String("upload", "", "also post random data to this URL")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: speedtest url [flags] <download url>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("one download url is needed")
+	}
+	opts, err := tf.options()
+	if err != nil {
+		return err
+	}
+	report, err := speedtest.ByURL(ctx, *interfaceOp, tf.timeout, fs.Arg(0), *uploadURL, opts)
+	if report == nil {
+		return err
+	}
+	if tf.jsonOut {
+		if err := printJSON(report); err != nil {
+			return err
+		}
+	} else {
+		printReport(os.Stdout, &report.SpeedReport)
+		fmt.Printf("TTFB:      %v over %d requests, ranged %v\n", report.TTFB, report.Requests, report.Ranged)
+	}
+	return err
+}
@@ -0,0 +1,284 @@
+package speedtest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const Iperf3Backend = "iperf3"
+
+// port iperf3 servers listen on by default
+const iperf3Port = "5201"
+
+// each direction of an iperf3 test runs this long when Options.Duration is not set
+const defaultIperf3Duration = 10 * time.Second
+
+func init() {
+	RegisterBackend(Iperf3Backend, newIperf3Backend)
+}
+
+// command: iperf3 -J, the parts of the output struct the backend reads
+type Iperf3Result struct {
+	Start struct {
+		Connected []struct {
+			LocalHost  string `json:"local_host"`
+			RemoteHost string `json:"remote_host"`
+		} `json:"connected"`
+		TestStart struct {
+			Protocol   string `json:"protocol"`
+			NumStreams int    `json:"num_streams"`
+			Reverse    int    `json:"reverse"`
+		} `json:"test_start"`
+	} `json:"start"`
+	End struct {
+		Streams []struct {
+			Sender struct {
+				MinRtt  int `json:"min_rtt"`  // microseconds, TCP on Linux only
+				MeanRtt int `json:"mean_rtt"` // microseconds, TCP on Linux only
+			} `json:"sender"`
+		} `json:"streams"`
+		SumSent     iperf3Sum `json:"sum_sent"`
+		SumReceived iperf3Sum `json:"sum_received"`
+		// UDP tests report here
+		Sum iperf3Sum `json:"sum"`
+	} `json:"end"`
+	Error string `json:"error"`
+}
+
+type iperf3Sum struct {
+	Seconds       float64 `json:"seconds"`
+	Bytes         int64   `json:"bytes"`
+	BitsPerSecond float64 `json:"bits_per_second"`
+	Retransmits   int     `json:"retransmits"`
+	JitterMs      float64 `json:"jitter_ms"`
+	LostPackets   int     `json:"lost_packets"`
+	Packets       int     `json:"packets"`
+	LostPercent   float64 `json:"lost_percent"`
+}
+
+// Iperf3Error is the error iperf3 reported in its JSON output
+type Iperf3Error struct {
+	Message string
+}
+
+func (e *Iperf3Error) Error() string {
+	return "iperf3: " + e.Message
+}
+
+// iperf3Backend runs the iperf3 binary against an iperf3 server, once for the
+// upload and once in reverse mode for the download
+type iperf3Backend struct {
+	cfg      BackendConfig
+	server   string
+	sourceIP string
+}
+
+func newIperf3Backend(cfg BackendConfig) (Backend, error) {
+	return &iperf3Backend{cfg: cfg}, nil
+}
+
+func (b *iperf3Backend) SelectServer(ctx context.Context, report *SpeedReport) error {
+	opts := b.cfg.Options
+	opts.progress(Progress{Phase: PhaseServerSelection, NetInterface: b.cfg.InterfaceOp})
+	dialer, err := getDialer(b.cfg.InterfaceOp, b.cfg.Timeout, opts)
+	if err != nil {
+		return err
+	}
+	b.sourceIP = dialer.sourceIP
+	switch {
+	case b.cfg.ServerID != "":
+		b.server = b.cfg.ServerID
+	case opts == nil || len(opts.Iperf3Servers) == 0:
+		return errors.New("not found iperf3 server")
+	case b.cfg.IsLatency && len(opts.Iperf3Servers) > 1:
+		b.server = fastestIperf3Server(ctx, dialer, opts.Iperf3Servers)
+	default:
+		b.server = opts.Iperf3Servers[0]
+	}
+	report.SpeedtestServer.ID = b.server
+	report.SpeedtestServer.Name = b.server
+	report.NetInterface.Name = b.cfg.InterfaceOp
+	report.NetInterface.InternalIp = b.sourceIP
+	report.NetInterface.Family = ipFamily(b.sourceIP, opts.family())
+	return nil
+}
+
+// the server accepting a TCP connection the fastest, the connection is closed
+// right away so the iperf3 server only logs a failed test
+func fastestIperf3Server(ctx context.Context, dialer *boundDialer, servers []string) string {
+	connect := make([]time.Duration, len(servers))
+	wg := sync.WaitGroup{}
+	for i := range servers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			connect[i] = time.Minute
+			sTime := time.Now()
+			conn, err := dialer.dial(ctx, iperf3Addr(servers[i]))
+			if err != nil {
+				return
+			}
+			connect[i] = time.Since(sTime)
+			conn.Close()
+		}(i)
+	}
+	wg.Wait()
+	order := make([]int, len(servers))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return connect[order[i]] < connect[order[j]] })
+	return servers[order[0]]
+}
+
+func iperf3Addr(server string) string {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+	return net.JoinHostPort(strings.Trim(server, "[]"), iperf3Port)
+}
+
+// iperf3 has no separate latency test, Upload fills the latency from the TCP round trips
+func (b *iperf3Backend) Latency(ctx context.Context, report *SpeedReport) error {
+	return nil
+}
+
+func (b *iperf3Backend) Upload(ctx context.Context, report *SpeedReport) error {
+	result, err := b.run(ctx, PhaseUpload, false)
+	if err != nil {
+		return err
+	}
+	sum := result.received()
+	report.UploadSpeed = sum.BitsPerSecond / 1000 / 1000
+	report.UploadBytes = sum.Bytes
+	report.UploadRetransmits = result.End.SumSent.Retransmits
+	b.fillCommon(result, report)
+	return nil
+}
+
+func (b *iperf3Backend) Download(ctx context.Context, report *SpeedReport) error {
+	result, err := b.run(ctx, PhaseDownload, true)
+	if err != nil {
+		return err
+	}
+	sum := result.received()
+	report.DownloadSpeed = sum.BitsPerSecond / 1000 / 1000
+	report.DownloadBytes = sum.Bytes
+	report.DownloadRetransmits = result.End.SumSent.Retransmits
+	b.fillCommon(result, report)
+	return nil
+}
+
+func (b *iperf3Backend) Close() error {
+	return nil
+}
+
+func (b *iperf3Backend) run(ctx context.Context, phase Phase, reverse bool) (*Iperf3Result, error) {
+	opts := b.cfg.Options
+	opts.progress(Progress{Phase: phase, NetInterface: b.cfg.InterfaceOp, Server: b.server})
+	duration := defaultIperf3Duration
+	if d := opts.duration(); d > 0 {
+		duration = d
+	}
+	host, port, err := net.SplitHostPort(iperf3Addr(b.server))
+	if err != nil {
+		return nil, err
+	}
+	args := []string{"-J", "-c", host, "-p", port,
+		"-t", strconv.Itoa(int((duration + time.Second - 1) / time.Second)),
+		"-P", strconv.Itoa(opts.streams()),
+	}
+	if b.sourceIP != "" {
+		args = append(args, "-B", b.sourceIP)
+	}
+	switch opts.family() {
+	case FamilyV4:
+		args = append(args, "-4")
+	case FamilyV6:
+		args = append(args, "-6")
+	}
+	if opts != nil && opts.Iperf3UDP {
+		args = append(args, "-u")
+	}
+	if opts != nil && opts.Iperf3Bandwidth != "" {
+		args = append(args, "-b", opts.Iperf3Bandwidth)
+	}
+	if reverse {
+		args = append(args, "-R")
+	}
+	// the run takes the test duration plus connection setup and the final exchange
+	timeout := int(duration/time.Second) + b.cfg.Timeout
+	path, args := opts.command(opts.iperf3Path(), args)
+	stdout, _, err := ExecCmdContext(ctx, path, timeout, args...)
+	var result Iperf3Result
+	if jsonErr := json.Unmarshal([]byte(stdout), &result); jsonErr != nil {
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("parse iperf3 output: %s", jsonErr.Error())
+	}
+	if result.Error != "" {
+		return nil, &Iperf3Error{Message: result.Error}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// the receiving side measures the throughput. UDP tests of older iperf3 builds only
+// have sum, which counts what was sent, there the lost packets are taken out of it
+func (r *Iperf3Result) received() iperf3Sum {
+	if !r.isUDP() || r.End.SumReceived.Seconds > 0 {
+		return r.End.SumReceived
+	}
+	sum := r.End.Sum
+	if sum.LostPercent > 0 {
+		delivered := 1 - sum.LostPercent/100
+		sum.BitsPerSecond *= delivered
+		sum.Bytes = int64(float64(sum.Bytes) * delivered)
+	}
+	return sum
+}
+
+func (r *Iperf3Result) isUDP() bool {
+	return strings.EqualFold(r.Start.TestStart.Protocol, "UDP")
+}
+
+func (b *iperf3Backend) fillCommon(result *Iperf3Result, report *SpeedReport) {
+	if len(result.Start.Connected) > 0 && report.NetInterface.InternalIp == "" {
+		report.NetInterface.InternalIp = result.Start.Connected[0].LocalHost
+	}
+	if result.isUDP() {
+		// the report has one jitter and loss for both directions, the worse one is kept
+		jitter := time.Duration(result.End.Sum.JitterMs * float64(time.Millisecond))
+		if jitter > report.Jitter {
+			report.Jitter = jitter
+		}
+		if result.End.Sum.LostPercent > report.PacketLoss {
+			report.PacketLoss = result.End.Sum.LostPercent
+		}
+		return
+	}
+	// like the native test the latency is half of the smallest round trip
+	minRtt := 0
+	for _, stream := range result.End.Streams {
+		if rtt := stream.Sender.MinRtt; rtt > 0 && (minRtt == 0 || rtt < minRtt) {
+			minRtt = rtt
+		}
+	}
+	if minRtt > 0 {
+		latency := time.Duration(minRtt) * time.Microsecond / 2
+		if report.Latency == 0 || latency < report.Latency {
+			report.Latency = latency
+		}
+	}
+}
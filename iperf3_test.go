@@ -0,0 +1,139 @@
+package speedtest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+const iperf3TCPOutput = `{
+	"start": {"connected": [{"local_host": "192.0.2.2", "remote_host": "192.0.2.9"}],
+		"test_start": {"protocol": "TCP", "num_streams": 1, "reverse": 0}},
+	"end": {
+		"streams": [{"sender": {"min_rtt": 1800, "mean_rtt": 2500}}],
+		"sum_sent": {"seconds": 10, "bytes": 125000000, "bits_per_second": 100000000, "retransmits": 7},
+		"sum_received": {"seconds": 10, "bytes": 120000000, "bits_per_second": 96000000}
+	}
+}`
+
+// iperf3 3.9 and later report the UDP receiver in sum_received
+const iperf3UDPOutput = `{
+	"start": {"test_start": {"protocol": "UDP"}},
+	"end": {
+		"sum": {"seconds": 10, "bytes": 12500000, "bits_per_second": 10000000, "jitter_ms": 0.25, "lost_packets": 100, "packets": 1000, "lost_percent": 10},
+		"sum_received": {"seconds": 10, "bytes": 11250000, "bits_per_second": 9000000}
+	}
+}`
+
+// older builds only have sum, counting what was sent
+const iperf3OldUDPOutput = `{
+	"start": {"test_start": {"protocol": "UDP"}},
+	"end": {
+		"sum": {"seconds": 10, "bytes": 12500000, "bits_per_second": 10000000, "jitter_ms": 0.25, "lost_packets": 250, "packets": 1000, "lost_percent": 25}
+	}
+}`
+
+func TestIperf3Received(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		bps    float64
+		bytes  int64
+	}{
+		{"tcp", iperf3TCPOutput, 96000000, 120000000},
+		{"udp", iperf3UDPOutput, 9000000, 11250000},
+		{"old udp", iperf3OldUDPOutput, 7500000, 9375000},
+	}
+	for _, tt := range tests {
+		var result Iperf3Result
+		if err := json.Unmarshal([]byte(tt.output), &result); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		sum := result.received()
+		if math.Abs(sum.BitsPerSecond-tt.bps) > 1 || sum.Bytes != tt.bytes {
+			t.Errorf("%s: received %.0f bit/s %d bytes, want %.0f bit/s %d bytes", tt.name, sum.BitsPerSecond, sum.Bytes, tt.bps, tt.bytes)
+		}
+	}
+}
+
+func TestIperf3FillCommon(t *testing.T) {
+	var tcp, udp Iperf3Result
+	json.Unmarshal([]byte(iperf3TCPOutput), &tcp)
+	json.Unmarshal([]byte(iperf3UDPOutput), &udp)
+	b := &iperf3Backend{}
+
+	var report SpeedReport
+	b.fillCommon(&tcp, &report)
+	// half of the smallest round trip
+	if report.Latency != 900*time.Microsecond {
+		t.Errorf("latency = %v, want 900µs", report.Latency)
+	}
+	if report.NetInterface.InternalIp != "192.0.2.2" {
+		t.Errorf("internal ip = %q, want the local host of the connection", report.NetInterface.InternalIp)
+	}
+
+	report = SpeedReport{}
+	b.fillCommon(&udp, &report)
+	if report.Jitter != 250*time.Microsecond || report.PacketLoss != 10 {
+		t.Errorf("jitter %v loss %v, want 250µs and 10%%", report.Jitter, report.PacketLoss)
+	}
+
+	// the upload and the download fill the same report, the worse jitter and loss stay
+	var old Iperf3Result
+	json.Unmarshal([]byte(iperf3OldUDPOutput), &old)
+	old.End.Sum.JitterMs = 0.1
+	for _, order := range [][]*Iperf3Result{{&udp, &old}, {&old, &udp}} {
+		report = SpeedReport{}
+		b.fillCommon(order[0], &report)
+		b.fillCommon(order[1], &report)
+		if report.Jitter != 250*time.Microsecond || report.PacketLoss != 25 {
+			t.Errorf("jitter %v loss %v, want the 250µs of one run and the 25%% of the other", report.Jitter, report.PacketLoss)
+		}
+	}
+}
+
+// the backend runs a script printing what iperf3 -J would
+func TestIperf3Backend(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake iperf3 is a shell script")
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "iperf3")
+	script := "#!/bin/sh\ncat <<'EOF'\n" + iperf3TCPOutput + "\nEOF\n"
+	if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	report, err := runTest(context.Background(), BackendConfig{
+		Timeout: 10,
+		Options: &Options{Backend: Iperf3Backend, Iperf3Path: path, Iperf3Servers: []string{"192.0.2.9"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.SpeedtestServer.ID != "192.0.2.9" {
+		t.Errorf("server = %q", report.SpeedtestServer.ID)
+	}
+	if report.UploadSpeed != 96 || report.DownloadSpeed != 96 || report.UploadRetransmits != 7 {
+		t.Errorf("upload %.2f download %.2f Mbit/s, %d retransmits, want 96, 96 and 7",
+			report.UploadSpeed, report.DownloadSpeed, report.UploadRetransmits)
+	}
+
+	script = "#!/bin/sh\necho '{\"error\": \"unable to connect to server\"}'\nexit 1\n"
+	if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	_, err = runTest(context.Background(), BackendConfig{
+		Timeout: 10,
+		Options: &Options{Backend: Iperf3Backend, Iperf3Path: path, Iperf3Servers: []string{"192.0.2.9"}},
+	})
+	var iperfErr *Iperf3Error
+	if !errors.As(err, &iperfErr) || iperfErr.Message != "unable to connect to server" {
+		t.Errorf("err = %v, want the Iperf3Error of the output", err)
+	}
+}
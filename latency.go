@@ -0,0 +1,155 @@
+package speedtest
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// probes sent to every candidate server while sorting by latency
+const selectionPings = 3
+
+// probes sent to the tested server when Options.Pings is not set
+const defaultPings = 10
+
+// LatencyStats describes the probes of a latency test. Like SpeedReport.Latency
+// every duration is half of the measured round trip
+type LatencyStats struct {
+	Min    time.Duration `json:"min"`
+	Avg    time.Duration `json:"avg"`
+	Median time.Duration `json:"median"`
+	Max    time.Duration `json:"max"`
+	StdDev time.Duration `json:"std_dev"`
+	// Jitter is the mean difference between consecutive probes
+	Jitter time.Duration `json:"jitter"`
+	Probes int           `json:"probes"`
+	Failed int           `json:"failed"`
+}
+
+// LatencyStatsContext probes latency.txt, or sends PING with TransportTCP, Options.Pings
+// times over one kept-alive connection, it fails only when no probe succeeded
+func (s *serverItem) LatencyStatsContext(ctx context.Context, interfaceOp string, timeout int) (*LatencyStats, error) {
+	return s.probeLatency(ctx, interfaceOp, timeout, s.opts.pings())
+}
+
+// probeLatency opens its own connection through interfaceOp with the transport of s.opts
+func (s *serverItem) probeLatency(ctx context.Context, interfaceOp string, timeout int, pings int) (*LatencyStats, error) {
+	if s.opts.transport() == TransportTCP {
+		dialer, err := getDialer(interfaceOp, timeout, s.opts)
+		if err != nil {
+			return nil, err
+		}
+		return s.tcpLatencyStats(ctx, dialer, pings)
+	}
+	httpUtil, err := getHttpUtil(interfaceOp, timeout, s.opts)
+	if err != nil {
+		return nil, err
+	}
+	defer httpUtil.Client.CloseIdleConnections()
+	return s.latencyStats(ctx, httpUtil.Client, pings)
+}
+
+func (s *serverItem) latencyStats(ctx context.Context, client *http.Client, pings int) (*LatencyStats, error) {
+	return pingStats(ctx, client, strings.Split(s.URL, "/upload.php")[0]+"/latency.txt", pings)
+}
+
+// pingStats sends pings requests to pingURL through client
+func pingStats(ctx context.Context, client *http.Client, pingURL string, pings int) (*LatencyStats, error) {
+	// open the connection first so that no probe pays for the handshakes,
+	// unless Options.FreshConnections asked for exactly that
+	if _, err := ping(ctx, client, pingURL); err != nil {
+		return nil, err
+	}
+	samples := make([]time.Duration, 0, pings)
+	failed := 0
+	var err error
+	for i := 0; i < pings; i++ {
+		var rtt time.Duration
+		rtt, err = ping(ctx, client, pingURL)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			failed++
+			continue
+		}
+		samples = append(samples, rtt/2)
+	}
+	if len(samples) == 0 {
+		return nil, err
+	}
+	return newLatencyStats(samples, failed), nil
+}
+
+// ping returns the time until the response headers of pingURL arrived
+func ping(ctx context.Context, client *http.Client, pingURL string) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pingURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	sTime := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	fTime := time.Now()
+	defer resp.Body.Close()
+	if err := checkStatus(resp); err != nil {
+		return 0, err
+	}
+	// drain the body so the connection can be reused
+	if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
+		return 0, err
+	}
+	return fTime.Sub(sTime), nil
+}
+
+// newLatencyStats summarizes the samples of the probes that succeeded, with no
+// sample only the probe counts are set
+func newLatencyStats(samples []time.Duration, failed int) *LatencyStats {
+	stats := &LatencyStats{
+		Probes: len(samples) + failed,
+		Failed: failed,
+	}
+	if len(samples) == 0 {
+		return stats
+	}
+	var sum, jitter time.Duration
+	for i, sample := range samples {
+		sum += sample
+		if i > 0 {
+			diff := sample - samples[i-1]
+			if diff < 0 {
+				diff = -diff
+			}
+			jitter += diff
+		}
+	}
+	stats.Avg = sum / time.Duration(len(samples))
+	if len(samples) > 1 {
+		stats.Jitter = jitter / time.Duration(len(samples)-1)
+	}
+	var variance float64
+	for _, sample := range samples {
+		d := float64(sample - stats.Avg)
+		variance += d * d
+	}
+	stats.StdDev = time.Duration(math.Sqrt(variance / float64(len(samples))))
+
+	sorted := make([]time.Duration, len(samples))
+	copy(sorted, samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	stats.Min = sorted[0]
+	stats.Max = sorted[len(sorted)-1]
+	if mid := len(sorted) / 2; len(sorted)%2 == 0 {
+		stats.Median = (sorted[mid-1] + sorted[mid]) / 2
+	} else {
+		stats.Median = sorted[mid]
+	}
+	return stats
+}
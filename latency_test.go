@@ -0,0 +1,79 @@
+package speedtest
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewLatencyStats(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name    string
+		samples []time.Duration
+		failed  int
+		want    LatencyStats
+	}{
+		{
+			name:    "odd",
+			samples: []time.Duration{10 * ms, 14 * ms, 12 * ms},
+			// jitter (4+2)/2, stddev sqrt((4+4+0)/3)
+			want: LatencyStats{Min: 10 * ms, Avg: 12 * ms, Median: 12 * ms, Max: 14 * ms, StdDev: 1632993, Jitter: 3 * ms, Probes: 3},
+		},
+		{
+			name:    "even",
+			samples: []time.Duration{20 * ms, 10 * ms, 40 * ms, 30 * ms},
+			failed:  1,
+			// median (20+30)/2, jitter (10+30+10)/3, stddev sqrt((25+225+225+25)/4)
+			want: LatencyStats{Min: 10 * ms, Avg: 25 * ms, Median: 25 * ms, Max: 40 * ms, StdDev: 11180339, Jitter: 16666666, Probes: 5, Failed: 1},
+		},
+		{
+			name:    "one sample",
+			samples: []time.Duration{7 * ms},
+			failed:  2,
+			want:    LatencyStats{Min: 7 * ms, Avg: 7 * ms, Median: 7 * ms, Max: 7 * ms, Probes: 3, Failed: 2},
+		},
+		{
+			name:   "all failed",
+			failed: 3,
+			want:   LatencyStats{Probes: 3, Failed: 3},
+		},
+	}
+	for _, tt := range tests {
+		got := newLatencyStats(tt.samples, tt.failed)
+		if got == nil || !reflect.DeepEqual(*got, tt.want) {
+			t.Errorf("%s: stats = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// pingStats counts the probes answered with an error as failed
+func TestPingStatsFailed(t *testing.T) {
+	var requests, failAll int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the first request opens the connection, then every other probe fails
+		n := atomic.AddInt32(&requests, 1)
+		if atomic.LoadInt32(&failAll) == 1 || n > 1 && n%2 == 0 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("test=test"))
+	}))
+	defer ts.Close()
+	stats, err := pingStats(context.Background(), ts.Client(), ts.URL+"/latency.txt", 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Probes != 6 || stats.Failed != 3 || stats.Min <= 0 {
+		t.Errorf("stats = %+v, want 6 probes, 3 of them failed", stats)
+	}
+
+	atomic.StoreInt32(&failAll, 1)
+	if stats, err := pingStats(context.Background(), ts.Client(), ts.URL+"/latency.txt", 3); err == nil {
+		t.Errorf("stats = %+v with every probe failed, want an error", stats)
+	}
+}
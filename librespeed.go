@@ -0,0 +1,272 @@
+package speedtest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const LibreSpeedBackend = "librespeed"
+
+// public LibreSpeed server list
+const libreSpeedServersUrl = "https://librespeed.org/backend-servers/servers.php"
+
+// each direction of a LibreSpeed test runs this long when Options.Duration is not set
+const defaultLibreSpeedDuration = 10 * time.Second
+
+// MiB chunks asked from garbage.php per download request
+const libreSpeedChunks = 100
+
+func init() {
+	RegisterBackend(LibreSpeedBackend, newLibreSpeedBackend)
+}
+
+// LibreSpeedServer is an entry of a LibreSpeed server list, the endpoint URLs
+// are relative to Server which may be protocol relative ("//host/")
+type LibreSpeedServer struct {
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	Server      string `json:"server"`
+	DlURL       string `json:"dlURL"`
+	UlURL       string `json:"ulURL"`
+	PingURL     string `json:"pingURL"`
+	GetIpURL    string `json:"getIpURL"`
+	SponsorName string `json:"sponsorName,omitempty"`
+	SponsorURL  string `json:"sponsorURL,omitempty"`
+}
+
+// resolve an endpoint of s to an absolute URL
+func (s *LibreSpeedServer) endpoint(ref string) (string, error) {
+	base := s.Server
+	if strings.HasPrefix(base, "//") {
+		base = "https:" + base
+	}
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	refURL, err := url.Parse(ref)
+	if err != nil {
+		return "", err
+	}
+	return baseURL.ResolveReference(refURL).String(), nil
+}
+
+// libreSpeedBackend measures with the garbage.php, empty.php and getIP.php endpoints of a LibreSpeed server
+type libreSpeedBackend struct {
+	cfg     BackendConfig
+	session *httpUtil
+	server  *LibreSpeedServer
+}
+
+func newLibreSpeedBackend(cfg BackendConfig) (Backend, error) {
+	return &libreSpeedBackend{cfg: cfg}, nil
+}
+
+func (b *libreSpeedBackend) SelectServer(ctx context.Context, report *SpeedReport) error {
+	opts := b.cfg.Options
+	opts.progress(Progress{Phase: PhaseServerSelection, NetInterface: b.cfg.InterfaceOp})
+	session, err := getHttpUtil(b.cfg.InterfaceOp, b.cfg.Timeout, opts)
+	if err != nil {
+		return err
+	}
+	b.session = session
+	servers, err := b.fetchServers(ctx)
+	if err != nil {
+		return err
+	}
+	if b.server, err = b.selectServer(ctx, servers); err != nil {
+		return err
+	}
+	report.SpeedtestServer.ID = strconv.Itoa(b.server.ID)
+	report.SpeedtestServer.Name = b.server.Name
+	report.SpeedtestServer.Sponsor = b.server.SponsorName
+	report.NetInterface.Name = b.cfg.InterfaceOp
+	report.NetInterface.InternalIp = session.Interface.InternalIp
+	report.NetInterface.Family = ipFamily(session.Interface.InternalIp, opts.family())
+	if b.server.GetIpURL != "" {
+		// the address is informative, a server without getIP.php can still be tested
+		report.NetInterface.ExternalIp, _ = b.externalIp(ctx)
+	}
+	return nil
+}
+
+func (b *libreSpeedBackend) fetchServers(ctx context.Context) ([]LibreSpeedServer, error) {
+	opts := b.cfg.Options
+	if opts != nil && opts.LibreSpeedServers != nil {
+		return opts.LibreSpeedServers, nil
+	}
+	serversURL := libreSpeedServersUrl
+	if opts != nil && opts.LibreSpeedServersURL != "" {
+		serversURL = opts.LibreSpeedServersURL
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, serversURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.session.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(resp); err != nil {
+		return nil, err
+	}
+	var servers []LibreSpeedServer
+	if err := json.NewDecoder(resp.Body).Decode(&servers); err != nil {
+		return nil, err
+	}
+	return servers, nil
+}
+
+// the server with cfg.ServerID, the one answering fastest when selecting by
+// latency, or else the first of the list as LibreSpeed has no coordinates
+func (b *libreSpeedBackend) selectServer(ctx context.Context, servers []LibreSpeedServer) (*LibreSpeedServer, error) {
+	if len(servers) == 0 {
+		return nil, errors.New("not found librespeed server")
+	}
+	if b.cfg.ServerID != "" {
+		for i := range servers {
+			if strconv.Itoa(servers[i].ID) == b.cfg.ServerID {
+				return &servers[i], nil
+			}
+		}
+		return nil, fmt.Errorf("not found librespeed server %s", b.cfg.ServerID)
+	}
+	if !b.cfg.IsLatency {
+		return &servers[0], nil
+	}
+	latencies := make([]time.Duration, len(servers))
+	wg := sync.WaitGroup{}
+	for i := range servers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			latencies[i] = time.Minute
+			pingURL, err := servers[i].endpoint(servers[i].PingURL)
+			if err != nil {
+				return
+			}
+			if stats, err := pingStats(ctx, b.session.Client, pingURL, selectionPings); err == nil {
+				latencies[i] = stats.Min
+			}
+		}(i)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	order := make([]int, len(servers))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return latencies[order[i]] < latencies[order[j]] })
+	return &servers[order[0]], nil
+}
+
+// getIP.php answers JSON with processedString "ip - isp" or, on old versions, the bare address
+func (b *libreSpeedBackend) externalIp(ctx context.Context) (string, error) {
+	getIpURL, err := b.server.endpoint(b.server.GetIpURL)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, getIpURL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := b.session.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(resp); err != nil {
+		return "", err
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return "", err
+	}
+	var reply struct {
+		ProcessedString string `json:"processedString"`
+	}
+	ip := strings.TrimSpace(string(body))
+	if json.Unmarshal(body, &reply) == nil {
+		ip = reply.ProcessedString
+	}
+	if i := strings.Index(ip, " - "); i >= 0 {
+		ip = ip[:i]
+	}
+	return ip, nil
+}
+
+func (b *libreSpeedBackend) Latency(ctx context.Context, report *SpeedReport) error {
+	opts := b.cfg.Options
+	opts.progress(Progress{Phase: PhaseLatency, NetInterface: b.cfg.InterfaceOp, Server: b.server.Name})
+	pingURL, err := b.server.endpoint(b.server.PingURL)
+	if err != nil {
+		return err
+	}
+	stats, err := pingStats(ctx, b.session.Client, noCacheURL(pingURL), opts.pings())
+	if err != nil {
+		return err
+	}
+	report.LatencyStats = stats
+	report.Latency = stats.Min
+	return nil
+}
+
+func (b *libreSpeedBackend) Upload(ctx context.Context, report *SpeedReport) (err error) {
+	ulURL, err := b.server.endpoint(b.server.UlURL)
+	if err != nil {
+		return err
+	}
+	ulURL = noCacheURL(ulURL)
+	opts := b.cfg.Options
+	p := Progress{Phase: PhaseUpload, NetInterface: b.cfg.InterfaceOp, Server: b.server.Name}
+	report.UploadSpeed, report.UploadBytes, err = opts.runFor(ctx, p, b.duration(), opts.streams(), func(runCtx context.Context, sent *int64) error {
+		return upload(runCtx, b.session.Client, ulURL, binaryContentType, newRandomPayload(int64(ulSizes[9])*1000), sent)
+	})
+	return err
+}
+
+func (b *libreSpeedBackend) Download(ctx context.Context, report *SpeedReport) (err error) {
+	dlURL, err := b.server.endpoint(b.server.DlURL)
+	if err != nil {
+		return err
+	}
+	dlURL = noCacheURL(dlURL) + "&ckSize=" + strconv.Itoa(libreSpeedChunks)
+	opts := b.cfg.Options
+	p := Progress{Phase: PhaseDownload, NetInterface: b.cfg.InterfaceOp, Server: b.server.Name}
+	report.DownloadSpeed, report.DownloadBytes, err = opts.runFor(ctx, p, b.duration(), opts.streams(), func(runCtx context.Context, received *int64) error {
+		return download(runCtx, b.session.Client, dlURL, received)
+	})
+	return err
+}
+
+// LibreSpeed only knows duration based tests
+func (b *libreSpeedBackend) duration() time.Duration {
+	if d := b.cfg.Options.duration(); d > 0 {
+		return d
+	}
+	return defaultLibreSpeedDuration
+}
+
+func (b *libreSpeedBackend) Close() error {
+	if b.session != nil {
+		b.session.Client.CloseIdleConnections()
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package speedtest
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// biggest ckSize served by garbage.php, as the LibreSpeed backend does
+const maxLibreSpeedChunks = 1024
+
+// LibreSpeedHandler serves the LibreSpeed backend endpoints garbage.php,
+// empty.php and getIP.php, and a server list at servers.json. Endpoints are
+// matched on the last path element, so the handler can be mounted under any prefix
+type LibreSpeedHandler struct {
+	ID      int
+	Name    string
+	Sponsor string
+	// Servers replaces the list served at servers.json, by default only this handler is listed
+	Servers []LibreSpeedServer
+}
+
+func (h *LibreSpeedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
+	switch path.Base(r.URL.Path) {
+	case "garbage.php":
+		h.serveGarbage(w, r)
+	case "empty.php":
+		io.Copy(ioutil.Discard, r.Body)
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+	case "getIP.php":
+		h.serveIP(w, r)
+	case "servers.json":
+		h.serveServers(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// garbage.php?ckSize=N sends N chunks of 1 MiB, 4 by default
+func (h *LibreSpeedHandler) serveGarbage(w http.ResponseWriter, r *http.Request) {
+	chunks := 4
+	if ckSize := r.URL.Query().Get("ckSize"); ckSize != "" {
+		n, err := strconv.Atoi(ckSize)
+		if err != nil || n <= 0 {
+			http.Error(w, "bad ckSize", http.StatusBadRequest)
+			return
+		}
+		chunks = n
+	}
+	if chunks > maxLibreSpeedChunks {
+		chunks = maxLibreSpeedChunks
+	}
+	length := int64(chunks) * 1024 * 1024
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Description", "File Transfer")
+	w.Header().Set("Content-Disposition", "attachment; filename=random.dat")
+	w.Header().Set("Content-Transfer-Encoding", "binary")
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	if r.Method == http.MethodHead {
+		return
+	}
+	io.Copy(w, newRandomPayload(length))
+}
+
+func (h *LibreSpeedHandler) serveIP(w http.ResponseWriter, r *http.Request) {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ip = host
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(struct {
+		ProcessedString string `json:"processedString"`
+		RawIspInfo      string `json:"rawIspInfo"`
+	}{ProcessedString: ip})
+}
+
+func (h *LibreSpeedHandler) serveServers(w http.ResponseWriter, r *http.Request) {
+	servers := h.Servers
+	if len(servers) == 0 {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		base := scheme + "://" + r.Host + path.Dir(r.URL.Path)
+		servers = []LibreSpeedServer{{
+			ID:          h.ID,
+			Name:        h.Name,
+			Server:      strings.TrimSuffix(base, "/") + "/",
+			DlURL:       "garbage.php",
+			UlURL:       "empty.php",
+			PingURL:     "empty.php",
+			GetIpURL:    "getIP.php",
+			SponsorName: h.Sponsor,
+		}}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(servers)
+}
@@ -0,0 +1,104 @@
+package speedtest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLibreSpeedEndpoint(t *testing.T) {
+	tests := []struct {
+		server, ref, want string
+	}{
+		{"http://host/speedtest/", "garbage.php", "http://host/speedtest/garbage.php"},
+		{"http://host/speedtest", "empty.php", "http://host/speedtest/empty.php"},
+		{"//host/", "backend/getIP.php", "https://host/backend/getIP.php"},
+		{"http://host/a/", "/empty.php", "http://host/empty.php"},
+	}
+	for _, tt := range tests {
+		s := LibreSpeedServer{Server: tt.server}
+		got, err := s.endpoint(tt.ref)
+		if err != nil || got != tt.want {
+			t.Errorf("endpoint(%q, %q) = %q, %v, want %q", tt.server, tt.ref, got, err, tt.want)
+		}
+	}
+}
+
+func TestLibreSpeedHandler(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/librespeed/", &LibreSpeedHandler{ID: 3, Name: "lab"})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/librespeed/garbage.php?ckSize=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || len(body) != 2<<20 {
+		t.Errorf("garbage.php?ckSize=2 = %d bytes, %v, want 2 MiB", len(body), err)
+	}
+	// bigger chunk counts are cut to maxLibreSpeedChunks
+	resp, err = http.Head(ts.URL + "/librespeed/garbage.php?ckSize=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ContentLength != maxLibreSpeedChunks<<20 {
+		t.Errorf("garbage.php?ckSize=5000 announces %d bytes, want %d MiB", resp.ContentLength, maxLibreSpeedChunks)
+	}
+	resp, err = http.Get(ts.URL + "/librespeed/garbage.php?ckSize=x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("garbage.php?ckSize=x = %s, want 400", resp.Status)
+	}
+
+	resp, err = http.Get(ts.URL + "/librespeed/servers.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var servers []LibreSpeedServer
+	err = json.NewDecoder(resp.Body).Decode(&servers)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 1 || servers[0].ID != 3 || servers[0].Server != ts.URL+"/librespeed/" {
+		t.Errorf("servers.json = %+v, want this handler under /librespeed/", servers)
+	}
+}
+
+func TestLibreSpeedBackend(t *testing.T) {
+	s := newTestServer(t, "/librespeed/", &LibreSpeedHandler{ID: 3, Name: "lab", Sponsor: "Acme"})
+	report := runBackendTest(t, &Options{
+		Backend:              LibreSpeedBackend,
+		LibreSpeedServersURL: s.URL + "/librespeed/servers.json",
+	})
+	s.checkTransfers(t, report)
+	if report.SpeedtestServer.ID != "3" || report.SpeedtestServer.Name != "lab" || report.SpeedtestServer.Sponsor != "Acme" {
+		t.Errorf("server = %+v", report.SpeedtestServer)
+	}
+	if report.NetInterface.ExternalIp != "127.0.0.1" {
+		t.Errorf("external ip = %q, want the one getIP.php saw", report.NetInterface.ExternalIp)
+	}
+	// the first empty.php opens the connection
+	if pings := len(s.served(http.MethodGet, "empty.php")); report.LatencyStats == nil || report.LatencyStats.Probes != 3 || pings != 4 {
+		t.Errorf("latency stats = %+v from %d GET empty.php, want 3 probes", report.LatencyStats, pings)
+	}
+	// every download asks for libreSpeedChunks MiB, the handler announces all of them
+	garbage := s.served(http.MethodGet, "garbage.php")
+	if len(garbage) == 0 {
+		t.Fatal("no garbage.php request")
+	}
+	for _, req := range garbage {
+		if ckSize := req.Query.Get("ckSize"); ckSize != "100" || req.ContentLength != "104857600" {
+			t.Errorf("garbage.php?ckSize=%s answered Content-Length %s, want 100 MiB", ckSize, req.ContentLength)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package speedtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// nativeBackend speaks the legacy Ookla HTTP protocol, or the TCP one with
+// TransportTCP, with the servers of speedtest.net
+type nativeBackend struct {
+	cfg        BackendConfig
+	server     *serverItem
+	session    *httpUtil
+	dialer     *boundDialer
+	externalIp string
+}
+
+func newNativeBackend(cfg BackendConfig) (Backend, error) {
+	return &nativeBackend{cfg: cfg}, nil
+}
+
+func (b *nativeBackend) SelectServer(ctx context.Context, report *SpeedReport) error {
+	if b.server == nil {
+		server, err := b.selectServer(ctx)
+		if err != nil {
+			return err
+		}
+		b.server = server
+	}
+	// every request of the test goes through the same client so connections can be reused
+	session, err := getHttpUtil(b.cfg.InterfaceOp, b.cfg.Timeout, b.cfg.Options)
+	if err != nil {
+		return err
+	}
+	b.session = session
+	if b.cfg.Options.transport() == TransportTCP {
+		if b.dialer, err = getDialer(b.cfg.InterfaceOp, b.cfg.Timeout, b.cfg.Options); err != nil {
+			return err
+		}
+	}
+	s := b.server
+	report.SpeedtestServer.ID = s.ID
+	report.SpeedtestServer.Lat = s.Lat
+	report.SpeedtestServer.Lon = s.Lon
+	report.SpeedtestServer.Name = s.Name
+	report.SpeedtestServer.Country = s.Country
+	report.SpeedtestServer.Sponsor = s.Sponsor
+	report.SpeedtestServer.Distance = s.Distance
+	report.NetInterface.Name = b.cfg.InterfaceOp
+	report.NetInterface.InternalIp = session.Interface.InternalIp
+	report.NetInterface.Family = ipFamily(session.Interface.InternalIp, b.cfg.Options.family())
+	report.NetInterface.ExternalIp = b.externalIp
+	return nil
+}
+
+func (b *nativeBackend) selectServer(ctx context.Context) (*serverItem, error) {
+	st, err := initStClient(ctx, b.cfg.InterfaceOp, b.cfg.Timeout, b.cfg.Options)
+	if err != nil {
+		return nil, err
+	}
+	b.externalIp = st.Config.IP
+	servers, err := st.FetchServerListContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if b.cfg.ServerID != "" {
+		for _, server := range servers {
+			if server.ID == b.cfg.ServerID {
+				return server, nil
+			}
+		}
+		return nil, fmt.Errorf("not found speedtest server %s", b.cfg.ServerID)
+	}
+	if b.cfg.IsLatency {
+		servers, err = st.ServerListByLatencyContext(ctx, servers)
+	} else {
+		servers, err = st.ServerListByDistance(servers)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(servers) == 0 {
+		return nil, errors.New("not found speedtest server")
+	}
+	return servers[0], nil
+}
+
+func (b *nativeBackend) Latency(ctx context.Context, report *SpeedReport) error {
+	s := b.server
+	s.opts.progress(Progress{Phase: PhaseLatency, NetInterface: b.cfg.InterfaceOp, Server: s.Name})
+	var stats *LatencyStats
+	var err error
+	if b.dialer != nil {
+		stats, err = s.tcpLatencyStats(ctx, b.dialer, s.opts.pings())
+	} else {
+		stats, err = s.latencyStats(ctx, b.session.Client, s.opts.pings())
+	}
+	if err != nil {
+		return err
+	}
+	report.LatencyStats = stats
+	report.Latency = stats.Min
+	return nil
+}
+
+func (b *nativeBackend) Upload(ctx context.Context, report *SpeedReport) (err error) {
+	if b.dialer != nil {
+		report.UploadSpeed, report.UploadBytes, err = b.server.tcpUploadFor(ctx, b.dialer, b.cfg.InterfaceOp)
+		return err
+	}
+	report.UploadSpeed, report.UploadBytes, err = b.server.uploadTest(ctx, b.session.Client, b.cfg.InterfaceOp, report.Latency)
+	return err
+}
+
+func (b *nativeBackend) Download(ctx context.Context, report *SpeedReport) (err error) {
+	if b.dialer != nil {
+		report.DownloadSpeed, report.DownloadBytes, err = b.server.tcpDownloadFor(ctx, b.dialer, b.cfg.InterfaceOp)
+		return err
+	}
+	report.DownloadSpeed, report.DownloadBytes, err = b.server.downloadTest(ctx, b.session.Client, b.cfg.InterfaceOp, report.Latency)
+	return err
+}
+
+func (b *nativeBackend) Close() error {
+	if b.session != nil {
+		b.session.Client.CloseIdleConnections()
+	}
+	return nil
+}
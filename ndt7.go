@@ -0,0 +1,444 @@
+package speedtest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const Ndt7Backend = "ndt7"
+
+// M-Lab service returning the ndt7 servers nearest to the caller
+const ndt7LocateUrl = "https://locate.measurementlab.net/v2/nearest/ndt/ndt7"
+
+const (
+	ndt7Subprotocol  = "net.measurementlab.ndt.v7"
+	ndt7DownloadPath = "/ndt/v7/download"
+	ndt7UploadPath   = "/ndt/v7/upload"
+)
+
+const (
+	// the upload runs this long when Options.Duration is not set, the server decides for the download
+	defaultNdt7Duration = 10 * time.Second
+	// a test is given up after this long whatever the peer does
+	ndt7MaxRuntime = 15 * time.Second
+	// how long the peer has to answer a close
+	ndt7CloseTimeout = 3 * time.Second
+	// binary messages start small and double while they are under 1/16 of the bytes sent
+	ndt7MinMessage   = 1 << 13
+	ndt7MaxMessage   = 1 << 20
+	ndt7MessageScale = 16
+)
+
+func init() {
+	RegisterBackend(Ndt7Backend, newNdt7Backend)
+}
+
+// Ndt7Measurement is the JSON text message both ends of an ndt7 test send while
+// it runs. Times and durations are in microseconds
+type Ndt7Measurement struct {
+	AppInfo        *Ndt7AppInfo        `json:"AppInfo,omitempty"`
+	ConnectionInfo *Ndt7ConnectionInfo `json:"ConnectionInfo,omitempty"`
+	BBRInfo        *Ndt7BBRInfo        `json:"BBRInfo,omitempty"`
+	TCPInfo        *Ndt7TCPInfo        `json:"TCPInfo,omitempty"`
+	Origin         string              `json:"Origin,omitempty"`
+	Test           string              `json:"Test,omitempty"`
+}
+
+// Ndt7AppInfo counts the payload bytes moved at the application level
+type Ndt7AppInfo struct {
+	ElapsedTime int64 `json:"ElapsedTime"`
+	NumBytes    int64 `json:"NumBytes"`
+}
+
+type Ndt7ConnectionInfo struct {
+	Client string `json:"Client"`
+	Server string `json:"Server"`
+	UUID   string `json:"UUID,omitempty"`
+}
+
+// Ndt7BBRInfo is the congestion control state of a server using BBR, BW in bytes per second
+type Ndt7BBRInfo struct {
+	BW          int64 `json:"BW"`
+	MinRTT      int64 `json:"MinRTT"`
+	ElapsedTime int64 `json:"ElapsedTime"`
+}
+
+// Ndt7TCPInfo is the subset of the kernel's tcp_info used by the backend
+type Ndt7TCPInfo struct {
+	RTT           int64 `json:"RTT,omitempty"`
+	RTTVar        int64 `json:"RTTVar,omitempty"`
+	MinRTT        int64 `json:"MinRTT,omitempty"`
+	TotalRetrans  int64 `json:"TotalRetrans,omitempty"`
+	BytesAcked    int64 `json:"BytesAcked,omitempty"`
+	BytesReceived int64 `json:"BytesReceived,omitempty"`
+	BytesSent     int64 `json:"BytesSent,omitempty"`
+	BytesRetrans  int64 `json:"BytesRetrans,omitempty"`
+	ElapsedTime   int64 `json:"ElapsedTime,omitempty"`
+}
+
+// ndt7LocateResult is an entry of the locate service reply
+type ndt7LocateResult struct {
+	Machine  string `json:"machine"`
+	Location struct {
+		City    string `json:"city"`
+		Country string `json:"country"`
+	} `json:"location"`
+	URLs map[string]string `json:"urls"`
+}
+
+// ndt7Backend speaks the M-Lab ndt7 protocol: one WebSocket per direction, the
+// data flows as binary messages and both ends report measurements as text messages
+type ndt7Backend struct {
+	cfg         BackendConfig
+	dialer      *boundDialer
+	server      string
+	downloadURL string
+	uploadURL   string
+}
+
+func newNdt7Backend(cfg BackendConfig) (Backend, error) {
+	return &ndt7Backend{cfg: cfg}, nil
+}
+
+func (b *ndt7Backend) SelectServer(ctx context.Context, report *SpeedReport) error {
+	opts := b.cfg.Options
+	opts.progress(Progress{Phase: PhaseServerSelection, NetInterface: b.cfg.InterfaceOp})
+	dialer, err := getDialer(b.cfg.InterfaceOp, b.cfg.Timeout, opts)
+	if err != nil {
+		return err
+	}
+	b.dialer = dialer
+	if opts != nil && opts.Ndt7URL != "" {
+		base, err := url.Parse(strings.TrimSuffix(opts.Ndt7URL, "/"))
+		if err != nil {
+			return err
+		}
+		switch base.Scheme {
+		case "http":
+			base.Scheme = "ws"
+		case "https":
+			base.Scheme = "wss"
+		}
+		b.server = base.Host
+		b.downloadURL = base.String() + ndt7DownloadPath
+		b.uploadURL = base.String() + ndt7UploadPath
+		report.SpeedtestServer.ID = b.server
+		report.SpeedtestServer.Name = b.server
+	} else {
+		result, err := b.locate(ctx)
+		if err != nil {
+			return err
+		}
+		b.server = result.Machine
+		report.SpeedtestServer.ID = result.Machine
+		report.SpeedtestServer.Name = result.Location.City
+		report.SpeedtestServer.Country = result.Location.Country
+		report.SpeedtestServer.Sponsor = "M-Lab"
+	}
+	report.NetInterface.Name = b.cfg.InterfaceOp
+	report.NetInterface.InternalIp = dialer.sourceIP
+	report.NetInterface.Family = ipFamily(dialer.sourceIP, opts.family())
+	return nil
+}
+
+// the nearest server the locate service knows, or the one named by cfg.ServerID.
+// Its URLs carry access tokens that are only valid for a short while
+func (b *ndt7Backend) locate(ctx context.Context) (*ndt7LocateResult, error) {
+	opts := b.cfg.Options
+	locateURL := ndt7LocateUrl
+	if opts != nil && opts.Ndt7LocateURL != "" {
+		locateURL = opts.Ndt7LocateURL
+	}
+	session, err := getHttpUtil(b.cfg.InterfaceOp, b.cfg.Timeout, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Client.CloseIdleConnections()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, locateURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := session.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(resp); err != nil {
+		return nil, err
+	}
+	var reply struct {
+		Results []ndt7LocateResult `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return nil, err
+	}
+	for i := range reply.Results {
+		result := &reply.Results[i]
+		if b.cfg.ServerID != "" && result.Machine != b.cfg.ServerID {
+			continue
+		}
+		for _, scheme := range []string{"wss", "ws"} {
+			download := result.URLs[scheme+"://"+ndt7DownloadPath]
+			upload := result.URLs[scheme+"://"+ndt7UploadPath]
+			if download != "" && upload != "" {
+				b.downloadURL, b.uploadURL = download, upload
+				return result, nil
+			}
+		}
+	}
+	if b.cfg.ServerID != "" {
+		return nil, fmt.Errorf("not found ndt7 server %s", b.cfg.ServerID)
+	}
+	return nil, errors.New("not found ndt7 server")
+}
+
+// ndt7 has no probe of its own, the latency comes from the server's TCPInfo during the transfers
+func (b *ndt7Backend) Latency(ctx context.Context, report *SpeedReport) error {
+	return nil
+}
+
+func (b *ndt7Backend) Download(ctx context.Context, report *SpeedReport) error {
+	conn, stop, err := b.connect(ctx, b.downloadURL)
+	if err != nil {
+		return err
+	}
+	defer stop()
+	opts := b.cfg.Options
+	var received int64
+	stopSampler := opts.startSampler(ctx, Progress{Phase: PhaseDownload, NetInterface: b.cfg.InterfaceOp, Server: b.server}, func() int64 {
+		return atomic.LoadInt64(&received)
+	})
+	sink := &ndt7Counter{n: &received}
+	var retransmits int64
+	sTime := time.Now()
+	for {
+		opcode, text, err := conn.readMessage(sink)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			stopSampler()
+			b.fillDownload(report, received, time.Since(sTime), retransmits)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if received > 0 {
+				// the server may cut the connection instead of closing it cleanly
+				return nil
+			}
+			return err
+		}
+		if opcode != wsText {
+			continue
+		}
+		var m Ndt7Measurement
+		if json.Unmarshal(text, &m) != nil {
+			continue
+		}
+		b.observe(&m, report)
+		if m.TCPInfo != nil && m.TCPInfo.TotalRetrans > retransmits {
+			retransmits = m.TCPInfo.TotalRetrans
+		}
+	}
+	stopSampler()
+	// the download is measured at the receiving end, like the reference client does
+	b.fillDownload(report, received, time.Since(sTime), retransmits)
+	return nil
+}
+
+func (b *ndt7Backend) fillDownload(report *SpeedReport, received int64, elapsed time.Duration, retransmits int64) {
+	report.DownloadBytes = received
+	if elapsed > 0 {
+		report.DownloadSpeed = float64(received) * 8 / 1000 / 1000 / elapsed.Seconds()
+	}
+	report.DownloadRetransmits = int(retransmits)
+}
+
+func (b *ndt7Backend) Upload(ctx context.Context, report *SpeedReport) error {
+	conn, stop, err := b.connect(ctx, b.uploadURL)
+	if err != nil {
+		return err
+	}
+	defer stop()
+	opts := b.cfg.Options
+	duration := defaultNdt7Duration
+	if d := opts.duration(); d > 0 {
+		duration = d
+	}
+	// servers cut a test off after ndt7MaxRuntime
+	if duration > ndt7MaxRuntime {
+		duration = ndt7MaxRuntime
+	}
+
+	// the server's view of the upload, read while sending
+	var last Ndt7Measurement
+	measurements := make(chan Ndt7Measurement)
+	readDone := make(chan error, 1)
+	quit := make(chan struct{})
+	defer close(quit)
+	go func() {
+		for {
+			opcode, text, err := conn.readMessage(ioutil.Discard)
+			if err != nil {
+				readDone <- err
+				return
+			}
+			var m Ndt7Measurement
+			if opcode == wsText && json.Unmarshal(text, &m) == nil {
+				select {
+				case measurements <- m:
+				case <-quit:
+					return
+				}
+			}
+		}
+	}()
+
+	var sent int64
+	stopSampler := opts.startSampler(ctx, Progress{Phase: PhaseUpload, NetInterface: b.cfg.InterfaceOp, Server: b.server}, func() int64 {
+		return atomic.LoadInt64(&sent)
+	})
+	payload := make([]byte, ndt7MaxMessage)
+	rand.Read(payload)
+	size := ndt7MinMessage
+	writeDone := make(chan error, 1)
+	sTime := time.Now()
+	go func() {
+		for time.Since(sTime) < duration && ctx.Err() == nil {
+			if err := conn.writeMessage(wsBinary, payload[:size]); err != nil {
+				writeDone <- err
+				return
+			}
+			total := atomic.AddInt64(&sent, int64(size))
+			if size < ndt7MaxMessage && int64(size) < total/ndt7MessageScale {
+				size *= 2
+			}
+		}
+		writeDone <- conn.close()
+	}()
+
+	var uploadErr error
+	writing, reading := true, true
+	grace := time.NewTimer(duration + ndt7CloseTimeout)
+	defer grace.Stop()
+	for writing || reading {
+		select {
+		case m := <-measurements:
+			b.observe(&m, report)
+			last = m
+		case err := <-writeDone:
+			writing = false
+			if err != nil && uploadErr == nil {
+				uploadErr = err
+			}
+			// give the server a moment to answer the close
+			if !grace.Stop() {
+				select {
+				case <-grace.C:
+				default:
+				}
+			}
+			grace.Reset(ndt7CloseTimeout)
+		case err := <-readDone:
+			reading = false
+			if err != io.EOF && writing && uploadErr == nil {
+				uploadErr = err
+			}
+		case <-grace.C:
+			reading = false
+			conn.conn.Close()
+		}
+	}
+	elapsed := time.Since(sTime)
+	stopSampler()
+
+	// the bytes the server acknowledged are the reference, what was written may still sit in buffers
+	report.UploadBytes = atomic.LoadInt64(&sent)
+	report.UploadSpeed = float64(report.UploadBytes) * 8 / 1000 / 1000 / elapsed.Seconds()
+	switch {
+	case last.TCPInfo != nil && last.TCPInfo.BytesReceived > 0 && last.TCPInfo.ElapsedTime > 0:
+		report.UploadBytes = last.TCPInfo.BytesReceived
+		report.UploadSpeed = float64(last.TCPInfo.BytesReceived) * 8 / float64(last.TCPInfo.ElapsedTime)
+	case last.AppInfo != nil && last.AppInfo.NumBytes > 0 && last.AppInfo.ElapsedTime > 0:
+		report.UploadBytes = last.AppInfo.NumBytes
+		report.UploadSpeed = float64(last.AppInfo.NumBytes) * 8 / float64(last.AppInfo.ElapsedTime)
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if uploadErr != nil && last.AppInfo == nil && last.TCPInfo == nil {
+		return uploadErr
+	}
+	return nil
+}
+
+// connect opens the WebSocket of one direction, stop closes it and releases the watcher of ctx
+func (b *ndt7Backend) connect(ctx context.Context, rawURL string) (conn *wsConn, stop func(), err error) {
+	conn, err = dialWebSocket(ctx, b.dialer, rawURL, ndt7Subprotocol)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.conn.SetDeadline(time.Now().Add(ndt7MaxRuntime + time.Duration(b.cfg.Timeout)*time.Second))
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.conn.Close()
+		case <-done:
+		}
+	}()
+	return conn, func() {
+		close(done)
+		conn.conn.Close()
+	}, nil
+}
+
+// observe keeps what a server measurement tells beyond the throughput
+func (b *ndt7Backend) observe(m *Ndt7Measurement, report *SpeedReport) {
+	if m.ConnectionInfo != nil && report.NetInterface.ExternalIp == "" {
+		if host, _, err := net.SplitHostPort(m.ConnectionInfo.Client); err == nil {
+			report.NetInterface.ExternalIp = host
+		}
+	}
+	// like the native test the latency is half of the smallest round trip
+	var rtt int64
+	switch {
+	case m.TCPInfo != nil && m.TCPInfo.MinRTT > 0:
+		rtt = m.TCPInfo.MinRTT
+	case m.BBRInfo != nil && m.BBRInfo.MinRTT > 0:
+		rtt = m.BBRInfo.MinRTT
+	case m.TCPInfo != nil && m.TCPInfo.RTT > 0:
+		rtt = m.TCPInfo.RTT
+	}
+	if rtt > 0 {
+		latency := time.Duration(rtt) * time.Microsecond / 2
+		if report.Latency == 0 || latency < report.Latency {
+			report.Latency = latency
+		}
+	}
+}
+
+func (b *ndt7Backend) Close() error {
+	return nil
+}
+
+// ndt7Counter counts the binary payload of the download
+type ndt7Counter struct {
+	n *int64
+}
+
+func (c *ndt7Counter) Write(p []byte) (int, error) {
+	atomic.AddInt64(c.n, int64(len(p)))
+	return len(p), nil
+}
@@ -0,0 +1,140 @@
+package speedtest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// server measurements are sent this often
+const ndt7MeasurementInterval = 250 * time.Millisecond
+
+// Ndt7Handler serves the ndt7 download and upload WebSockets. Endpoints are
+// matched on the end of the path, so the handler can be mounted under any prefix
+type Ndt7Handler struct {
+	// Duration of a download, 10s by default
+	Duration time.Duration
+}
+
+func (h *Ndt7Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasSuffix(r.URL.Path, ndt7DownloadPath):
+		h.serveDownload(w, r)
+	case strings.HasSuffix(r.URL.Path, ndt7UploadPath):
+		h.serveUpload(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *Ndt7Handler) serveDownload(w http.ResponseWriter, r *http.Request) {
+	conn, err := acceptWebSocket(w, r, ndt7Subprotocol)
+	if err != nil {
+		return
+	}
+	defer conn.conn.Close()
+	conn.conn.SetDeadline(time.Now().Add(ndt7MaxRuntime))
+	duration := h.Duration
+	if duration <= 0 || duration > ndt7MaxRuntime {
+		duration = defaultNdt7Duration
+	}
+	// the client may send measurements of its own, they are not used
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		for {
+			if _, _, err := conn.readMessage(ioutil.Discard); err != nil {
+				return
+			}
+		}
+	}()
+
+	payload := make([]byte, ndt7MaxMessage)
+	rand.Read(payload)
+	size := ndt7MinMessage
+	var sent int64
+	sTime := time.Now()
+	next := sTime
+	for time.Since(sTime) < duration {
+		if time.Now().After(next) {
+			if h.sendMeasurement(conn, "download", sTime, sent) != nil {
+				return
+			}
+			next = next.Add(ndt7MeasurementInterval)
+		}
+		if conn.writeMessage(wsBinary, payload[:size]) != nil {
+			return
+		}
+		sent += int64(size)
+		if size < ndt7MaxMessage && int64(size) < sent/ndt7MessageScale {
+			size *= 2
+		}
+	}
+	h.sendMeasurement(conn, "download", sTime, sent)
+	conn.close()
+	select {
+	case <-readDone:
+	case <-time.After(ndt7CloseTimeout):
+	}
+}
+
+func (h *Ndt7Handler) serveUpload(w http.ResponseWriter, r *http.Request) {
+	conn, err := acceptWebSocket(w, r, ndt7Subprotocol)
+	if err != nil {
+		return
+	}
+	defer conn.conn.Close()
+	conn.conn.SetDeadline(time.Now().Add(ndt7MaxRuntime))
+	var received int64
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		sink := &ndt7Counter{n: &received}
+		for {
+			// the client ends the upload with a close, answered by readMessage
+			if _, _, err := conn.readMessage(sink); err != nil {
+				return
+			}
+		}
+	}()
+	sTime := time.Now()
+	ticker := time.NewTicker(ndt7MeasurementInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if h.sendMeasurement(conn, "upload", sTime, atomic.LoadInt64(&received)) != nil {
+				<-readDone
+				return
+			}
+		case <-readDone:
+			return
+		}
+	}
+}
+
+func (h *Ndt7Handler) sendMeasurement(conn *wsConn, test string, sTime time.Time, bytes int64) error {
+	elapsed := int64(time.Since(sTime) / time.Microsecond)
+	m := Ndt7Measurement{
+		AppInfo: &Ndt7AppInfo{ElapsedTime: elapsed, NumBytes: bytes},
+		ConnectionInfo: &Ndt7ConnectionInfo{
+			Client: conn.conn.RemoteAddr().String(),
+			Server: conn.conn.LocalAddr().String(),
+		},
+		Origin: "server",
+		Test:   test,
+	}
+	if info := tcpInfo(conn.conn); info != nil {
+		info.ElapsedTime = elapsed
+		m.TCPInfo = info
+	}
+	message, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return conn.writeMessage(wsText, message)
+}
@@ -0,0 +1,62 @@
+//go:build linux && !386
+// +build linux,!386
+
+package speedtest
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// linuxTCPInfo is struct tcp_info of linux/tcp.h up to tcpi_bytes_retrans,
+// older kernels fill less of it and leave the rest zero
+type linuxTCPInfo struct {
+	State, CaState, Retransmits, Probes, Backoff, Options, WScale, Flags uint8
+
+	Rto, Ato, SndMss, RcvMss                             uint32
+	Unacked, Sacked, Lost, Retrans, Fackets              uint32
+	LastDataSent, LastAckSent, LastDataRecv, LastAckRecv uint32
+	Pmtu, RcvSsthresh, Rtt, Rttvar, SndSsthresh          uint32
+	SndCwnd, Advmss, Reordering, RcvRtt, RcvSpace        uint32
+	TotalRetrans                                         uint32
+
+	PacingRate, MaxPacingRate, BytesAcked, BytesReceived uint64
+	SegsOut, SegsIn                                      uint32
+	NotsentBytes, MinRtt, DataSegsIn, DataSegsOut        uint32
+	DeliveryRate, BusyTime, RwndLimited, SndbufLimited   uint64
+	Delivered, DeliveredCe                               uint32
+	BytesSent, BytesRetrans                              uint64
+}
+
+// tcpInfo reads the kernel's view of conn, nil when it is not a TCP connection
+func tcpInfo(conn net.Conn) *Ndt7TCPInfo {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	var info linuxTCPInfo
+	var sockErr syscall.Errno
+	err = raw.Control(func(fd uintptr) {
+		size := uint32(unsafe.Sizeof(info))
+		_, _, sockErr = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, syscall.TCP_INFO,
+			uintptr(unsafe.Pointer(&info)), uintptr(unsafe.Pointer(&size)), 0)
+	})
+	if err != nil || sockErr != 0 {
+		return nil
+	}
+	return &Ndt7TCPInfo{
+		RTT:           int64(info.Rtt),
+		RTTVar:        int64(info.Rttvar),
+		MinRTT:        int64(info.MinRtt),
+		TotalRetrans:  int64(info.TotalRetrans),
+		BytesAcked:    int64(info.BytesAcked),
+		BytesReceived: int64(info.BytesReceived),
+		BytesSent:     int64(info.BytesSent),
+		BytesRetrans:  int64(info.BytesRetrans),
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux || 386
+// +build !linux 386
+
+package speedtest
+
+import "net"
+
+// tcp_info is only read on linux, 386 has no getsockopt syscall of its own
+func tcpInfo(conn net.Conn) *Ndt7TCPInfo {
+	return nil
+}
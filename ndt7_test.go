@@ -0,0 +1,155 @@
+package speedtest
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNdt7Backend(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/ndt7/", &Ndt7Handler{Duration: testTransferDuration})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	report := runBackendTest(t, &Options{Backend: Ndt7Backend, Ndt7URL: ts.URL + "/ndt7"})
+	if report.SpeedtestServer.ID != ts.Listener.Addr().String() {
+		t.Errorf("server = %q, want the handler's host", report.SpeedtestServer.ID)
+	}
+	// the handler decides how long the download runs
+	checkSpeed(t, "download", report.DownloadSpeed, report.DownloadBytes)
+	if report.UploadBytes <= 0 || report.UploadSpeed <= 0 {
+		t.Errorf("upload = %d bytes %.2f Mbit/s, want both positive", report.UploadBytes, report.UploadSpeed)
+	}
+	if report.NetInterface.ExternalIp != "127.0.0.1" {
+		t.Errorf("external ip = %q, want the one of the server measurements", report.NetInterface.ExternalIp)
+	}
+	if runtime.GOOS == "linux" && runtime.GOARCH != "386" && report.Latency <= 0 {
+		t.Error("no latency from the tcp_info of the server measurements")
+	}
+}
+
+// the backend takes the bytes it received, the retransmits, latency and address
+// from the download and the upload bytes and speed from the server's last measurement
+func TestNdt7BackendMeasurements(t *testing.T) {
+	const downloadBytes = 3*ndt7MinMessage + 100
+	measurement := func(conn *wsConn, m Ndt7Measurement) {
+		message, _ := json.Marshal(m)
+		conn.writeMessage(wsText, message)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := acceptWebSocket(w, r, ndt7Subprotocol)
+		if err != nil {
+			return
+		}
+		defer conn.conn.Close()
+		conn.conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if strings.HasSuffix(r.URL.Path, ndt7DownloadPath) {
+			for _, size := range []int{ndt7MinMessage, 2 * ndt7MinMessage, 100} {
+				conn.writeMessage(wsBinary, make([]byte, size))
+			}
+			measurement(conn, Ndt7Measurement{
+				ConnectionInfo: &Ndt7ConnectionInfo{Client: "198.51.100.7:40000"},
+				TCPInfo:        &Ndt7TCPInfo{MinRTT: 8000, TotalRetrans: 3},
+			})
+			conn.close()
+			conn.readMessage(ioutil.Discard)
+			return
+		}
+		// 1.25 MB in 0.1s is 100 Mbit/s, whatever the client sent
+		measurement(conn, Ndt7Measurement{AppInfo: &Ndt7AppInfo{NumBytes: 1250000, ElapsedTime: 100000}})
+		for {
+			if _, _, err := conn.readMessage(ioutil.Discard); err != nil {
+				return
+			}
+		}
+	}))
+	defer ts.Close()
+
+	report := runBackendTest(t, &Options{Backend: Ndt7Backend, Ndt7URL: ts.URL})
+	if report.DownloadBytes != downloadBytes || report.DownloadRetransmits != 3 {
+		t.Errorf("download = %d bytes %d retransmits, want %d and 3", report.DownloadBytes, report.DownloadRetransmits, downloadBytes)
+	}
+	if report.Latency != 4*time.Millisecond || report.NetInterface.ExternalIp != "198.51.100.7" {
+		t.Errorf("latency %v external ip %q, want half the 8ms MinRTT and the measured client", report.Latency, report.NetInterface.ExternalIp)
+	}
+	if report.UploadBytes != 1250000 || report.UploadSpeed != 100 {
+		t.Errorf("upload = %d bytes %.2f Mbit/s, want the server's 1250000 and 100", report.UploadBytes, report.UploadSpeed)
+	}
+}
+
+// the handler's measurements count the bytes moved before them
+func TestNdt7HandlerMeasurements(t *testing.T) {
+	ts := httptest.NewServer(&Ndt7Handler{Duration: testTransferDuration})
+	defer ts.Close()
+	dialer, err := getDialer("", 5, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialWebSocket(context.Background(), dialer, "ws"+strings.TrimPrefix(ts.URL, "http")+ndt7DownloadPath, ndt7Subprotocol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.conn.Close()
+	conn.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	var received int64
+	sink := &ndt7Counter{n: &received}
+	var last Ndt7Measurement
+	measurements := 0
+	for {
+		opcode, text, err := conn.readMessage(sink)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opcode != wsText {
+			continue
+		}
+		var m Ndt7Measurement
+		if err := json.Unmarshal(text, &m); err != nil {
+			t.Fatalf("measurement %q: %v", text, err)
+		}
+		if m.Origin != "server" || m.Test != "download" || m.AppInfo == nil || m.AppInfo.NumBytes != received {
+			t.Errorf("measurement %s after %d bytes, want the server's count of them", text, received)
+		}
+		if m.AppInfo != nil && last.AppInfo != nil && m.AppInfo.ElapsedTime < last.AppInfo.ElapsedTime {
+			t.Errorf("elapsed time went back from %d to %d", last.AppInfo.ElapsedTime, m.AppInfo.ElapsedTime)
+		}
+		last = m
+		measurements++
+	}
+	// one every ndt7MeasurementInterval from the start, and the last one
+	if measurements < 3 || received == 0 {
+		t.Errorf("%d measurements over %d bytes", measurements, received)
+	}
+}
+
+func TestNdt7HandlerPaths(t *testing.T) {
+	ts := httptest.NewServer(&Ndt7Handler{})
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + "/ndt/v7/other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown path = %s, want 404", resp.Status)
+	}
+	// the endpoints only speak WebSocket
+	resp, err = http.Get(ts.URL + ndt7DownloadPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("plain GET of the download = %s, want 400", resp.Status)
+	}
+}
@@ -0,0 +1,105 @@
+package speedtest
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+)
+
+// where ip netns add bind mounts the named namespaces
+const netnsDir = "/var/run/netns"
+
+// ip netns exec bind mounts the files of /etc/netns/<name> over those of /etc
+var netnsEtcDir = "/etc/netns"
+
+// inNetns runs fn on an OS thread switched into the named network namespace,
+// sockets keep the namespace they were created in once the thread switches back.
+// With an empty name fn runs as it is
+func inNetns(name string, fn func() error) error {
+	if name == "" {
+		return fn()
+	}
+	path, err := netnsPath(name)
+	if err != nil {
+		return err
+	}
+	target, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("netns %s: %w", name, err)
+	}
+	defer target.Close()
+
+	// a fresh goroutine so the caller's thread never changes namespace
+	errc := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		origin, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", syscall.Gettid()))
+		if err != nil {
+			runtime.UnlockOSThread()
+			errc <- err
+			return
+		}
+		defer origin.Close()
+		if err := setns(target.Fd()); err != nil {
+			runtime.UnlockOSThread()
+			errc <- fmt.Errorf("enter netns %s: %w", name, err)
+			return
+		}
+		err = fn()
+		// a thread stuck in the namespace stays locked, the runtime then
+		// throws it away when the goroutine exits instead of reusing it
+		if setns(origin.Fd()) == nil {
+			runtime.UnlockOSThread()
+		}
+		errc <- err
+	}()
+	return <-errc
+}
+
+func netnsPath(name string) (string, error) {
+	if name == "." || name == ".." || filepath.Base(name) != name {
+		return "", fmt.Errorf("invalid netns name %q", name)
+	}
+	return filepath.Join(netnsDir, name), nil
+}
+
+func setns(fd uintptr) error {
+	_, _, errno := syscall.RawSyscall(sysSetns, fd, syscall.CLONE_NEWNET, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// netnsNameservers are the host:port nameservers of /etc/netns/<name>/resolv.conf,
+// nil when the namespace has no resolv.conf of its own
+func netnsNameservers(name string) []string {
+	if _, err := netnsPath(name); err != nil {
+		return nil
+	}
+	f, err := os.Open(filepath.Join(netnsEtcDir, name, "resolv.conf"))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var servers []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		// the zone of a link-local server stays in the host part
+		host := fields[1]
+		if ip := net.ParseIP(strings.SplitN(host, "%", 2)[0]); ip == nil {
+			continue
+		}
+		servers = append(servers, net.JoinHostPort(host, "53"))
+	}
+	return servers
+}
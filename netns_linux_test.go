@@ -0,0 +1,79 @@
+package speedtest
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNetnsNameservers(t *testing.T) {
+	etc := netnsEtcDir
+	defer func() { netnsEtcDir = etc }()
+	netnsEtcDir = t.TempDir()
+	if err := os.Mkdir(filepath.Join(netnsEtcDir, "blue"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	resolvConf := `# written by hand
+nameserver 192.0.2.53
+search example.org
+nameserver 2001:db8::53
+nameserver fe80::1%eth0
+nameserver not-an-address
+nameserver
+options ndots:2
+`
+	if err := ioutil.WriteFile(filepath.Join(netnsEtcDir, "blue", "resolv.conf"), []byte(resolvConf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// a resolv.conf next to the directories must not be read for a name with a path
+	if err := ioutil.WriteFile(filepath.Join(netnsEtcDir, "resolv.conf"), []byte(resolvConf), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"192.0.2.53:53", "[2001:db8::53]:53", "[fe80::1%eth0]:53"}
+	if got := netnsNameservers("blue"); !reflect.DeepEqual(got, want) {
+		t.Errorf("nameservers of blue = %q, want %q", got, want)
+	}
+	for _, name := range []string{"red", "..", "blue/..", "../x"} {
+		if got := netnsNameservers(name); got != nil {
+			t.Errorf("nameservers of %q = %q, want nil", name, got)
+		}
+	}
+}
+
+func TestNetnsPath(t *testing.T) {
+	if path, err := netnsPath("blue"); err != nil || path != filepath.Join(netnsDir, "blue") {
+		t.Errorf("netnsPath(blue) = %q, %v", path, err)
+	}
+	for _, name := range []string{".", "..", "../x", "a/b", "/var/run/netns/blue"} {
+		if _, err := netnsPath(name); err == nil || !strings.Contains(err.Error(), "invalid netns name") {
+			t.Errorf("netnsPath(%q) = %v, want an invalid name error", name, err)
+		}
+	}
+}
+
+func TestInNetns(t *testing.T) {
+	errFn := errors.New("fn")
+	ran := false
+	if err := inNetns("", func() error { ran = true; return errFn }); err != errFn || !ran {
+		t.Errorf("inNetns without a name = %v ran %v, want fn run and its error", err, ran)
+	}
+	ran = false
+	err := inNetns("speedtest-missing", func() error { ran = true; return nil })
+	if err == nil || !errors.Is(err, os.ErrNotExist) || ran {
+		t.Errorf("inNetns of a missing namespace = %v ran %v, want a not exist error", err, ran)
+	}
+	if err := inNetns("../x", func() error { ran = true; return nil }); err == nil || ran {
+		t.Errorf("inNetns with a path = %v ran %v, want an error", err, ran)
+	}
+}
+
+func TestDialerMissingNetns(t *testing.T) {
+	if _, err := getDialer("", 5, &Options{Netns: "speedtest-missing"}); err == nil {
+		t.Error("a dialer in a namespace that does not exist")
+	}
+}
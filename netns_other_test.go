@@ -0,0 +1,27 @@
+//go:build !linux
+// +build !linux
+
+package speedtest
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestInNetns(t *testing.T) {
+	ran := false
+	if err := inNetns("", func() error { ran = true; return nil }); err != nil || !ran {
+		t.Errorf("inNetns without a name = %v ran %v, want fn run", err, ran)
+	}
+	ran = false
+	err := inNetns("blue", func() error { ran = true; return nil })
+	if err == nil || !strings.Contains(err.Error(), "only supported on linux") || ran {
+		t.Errorf("inNetns(blue) = %v ran %v, want the linux only error", err, ran)
+	}
+	if _, err := getDialer("", 5, &Options{Netns: "blue"}); err == nil {
+		t.Error("a dialer in a namespace on a system without them")
+	}
+	if netnsNameservers("blue") != nil {
+		t.Error("nameservers of a namespace on a system without them")
+	}
+}
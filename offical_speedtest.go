@@ -1,9 +1,12 @@
 package speedtest
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
+	"strconv"
 	"time"
 )
 
@@ -14,19 +17,16 @@ type SpeedtestCliResult struct {
 	Ping      struct {
 		Jitter  float64 `json:"jitter"`
 		Latency float64 `json:"latency"`
+		Low     float64 `json:"low,omitempty"`
+		High    float64 `json:"high,omitempty"`
+		// share of the phase done, in progress events only
+		Progress float64 `json:"progress,omitempty"`
 	} `json:"ping"`
-	Download struct {
-		Bandwidth int `json:"bandwidth"`
-		Bytes     int `json:"bytes"`
-		Elapsed   int `json:"elapsed"`
-	} `json:"download"`
-	Upload struct {
-		Bandwidth int `json:"bandwidth"`
-		Bytes     int `json:"bytes"`
-		Elapsed   int `json:"elapsed"`
-	} `json:"upload"`
-	PacketLoss int    `json:"packetLoss"`
-	Isp        string `json:"isp"`
+	Download SpeedtestCliTransfer `json:"download"`
+	Upload   SpeedtestCliTransfer `json:"upload"`
+	// percent, nil when the CLI could not measure it
+	PacketLoss *float64 `json:"packetLoss,omitempty"`
+	Isp        string   `json:"isp"`
 	Interface  struct {
 		InternalIP string `json:"internalIp"`
 		Name       string `json:"name"`
@@ -44,47 +44,302 @@ type SpeedtestCliResult struct {
 		IP       string `json:"ip"`
 	} `json:"server"`
 	Result struct {
-		ID  string `json:"id"`
-		URL string `json:"url"`
+		ID        string `json:"id"`
+		URL       string `json:"url"`
+		Persisted bool   `json:"persisted"`
 	} `json:"result"`
 }
 
+// SpeedtestCliTransfer is one direction of a CLI result, Bandwidth is in bytes
+// per second and the times are in milliseconds
+type SpeedtestCliTransfer struct {
+	Bandwidth int64 `json:"bandwidth"`
+	Bytes     int64 `json:"bytes"`
+	Elapsed   int64 `json:"elapsed"`
+	// share of the phase done, in progress events only
+	Progress float64 `json:"progress,omitempty"`
+	// latency under load, reported by recent versions
+	Latency *struct {
+		Iqm    float64 `json:"iqm"`
+		Low    float64 `json:"low"`
+		High   float64 `json:"high"`
+		Jitter float64 `json:"jitter"`
+	} `json:"latency,omitempty"`
+}
+
+// SpeedtestCliEvent is a line of `speedtest -f jsonl`: "testStart", "ping",
+// "download" and "upload" progress, the final "result", or a "log" message
+type SpeedtestCliEvent struct {
+	SpeedtestCliResult
+	Message string `json:"message,omitempty"`
+	Level   string `json:"level,omitempty"`
+}
+
+// SpeedtestCliError is the error the CLI logged before it failed
+type SpeedtestCliError struct {
+	Level   string
+	Message string
+	// Err is how the process ended
+	Err error
+}
+
+func (e *SpeedtestCliError) Error() string {
+	return "speedtest cli: " + e.Message
+}
+
+func (e *SpeedtestCliError) Unwrap() error {
+	return e.Err
+}
+
 // you must install speedtest cli
 func BySpeedtestCli(interfaceOps []string, cmdTimoutSecond int) (BatchReport, error) {
+	return BySpeedtestCliContext(context.Background(), interfaceOps, cmdTimoutSecond)
+}
+
+// BySpeedtestCliContext is like BySpeedtestCli but stops when ctx is done,
+// interfaces tested before that are kept in the returned report
+func BySpeedtestCliContext(ctx context.Context, interfaceOps []string, cmdTimoutSecond int) (BatchReport, error) {
+	return BySpeedtestCliWithOptions(ctx, interfaceOps, cmdTimoutSecond, nil)
+}
+
+// BySpeedtestCliWithOptions is like BySpeedtestCliContext, opts may be nil and
+// its Backend is ignored. A missing or unusable binary fails the whole batch
+// with a *SpeedtestCliUnavailableError
+func BySpeedtestCliWithOptions(ctx context.Context, interfaceOps []string, cmdTimoutSecond int, opts *Options) (BatchReport, error) {
 	var batchReport BatchReport
 	if len(interfaceOps) == 0 {
 		return batchReport, errors.New("interfaceOps less 1")
 	}
-	var failedNet []string
-	var reports []*SpeedReport
+	cliOpts := Options{}
+	if opts != nil {
+		cliOpts = *opts
+	}
+	cliOpts.Backend = OoklaCliBackend
+	info, err := DetectSpeedtestCli(ctx, cliOpts.speedtestCliPath())
+	if err != nil {
+		return batchReport, err
+	}
 	for _, interfaceOp := range interfaceOps {
-		_, stdout, err := ExecCmd("speedtest", cmdTimoutSecond, "--accept-license", "-I", interfaceOp, "-f", "json")
-		if err != nil {
-			failedNet = append(failedNet, interfaceOp)
-			continue
+		if ctx.Err() != nil {
+			return batchReport, ctx.Err()
+		}
+		report, err := runTest(ctx, BackendConfig{
+			InterfaceOp: interfaceOp,
+			Timeout:     cmdTimoutSecond,
+			Options:     &cliOpts,
+			// run --version once for the whole batch
+			speedtestCli: info,
+		})
+		batchReport.add(interfaceOp, report, err)
+	}
+	return batchReport, ctx.Err()
+}
+
+// ooklaCliBackend runs the official speedtest binary, the binary measures
+// everything at once so the whole run happens in Latency, the first measuring
+// step. Its jsonl events are passed on to Options.Progress while it runs
+type ooklaCliBackend struct {
+	cfg  BackendConfig
+	path string
+}
+
+func newOoklaCliBackend(cfg BackendConfig) (Backend, error) {
+	return &ooklaCliBackend{cfg: cfg}, nil
+}
+
+// the binary picks the server itself once it runs, here it is only looked for
+func (b *ooklaCliBackend) SelectServer(ctx context.Context, report *SpeedReport) error {
+	opts := b.cfg.Options
+	opts.progress(Progress{Phase: PhaseServerSelection, NetInterface: b.cfg.InterfaceOp})
+	info := b.cfg.speedtestCli
+	if info == nil {
+		var err error
+		if info, err = DetectSpeedtestCli(ctx, opts.speedtestCliPath()); err != nil {
+			return err
+		}
+	}
+	b.path = info.Path
+	return nil
+}
+
+// arguments of a run, a source address is passed along with the interface
+// when Options.Family asks for one family or Options.Mark picks a route
+func (b *ooklaCliBackend) args() (args []string, sourceIP string, err error) {
+	interfaceOp := b.cfg.InterfaceOp
+	opts := b.cfg.Options
+	family := opts.family()
+	args = []string{"--accept-license"}
+	isIP := net.ParseIP(interfaceOp) != nil
+	if interfaceOp != "" && !isIP {
+		args = append(args, "-I", interfaceOp)
+	}
+	switch {
+	case isIP || interfaceOp != "" && family != FamilyAny:
+		err = inNetns(opts.netns(), func() (err error) {
+			sourceIP, err = getSourceIP(interfaceOp, family)
+			return err
+		})
+	case family != FamilyAny || opts.mark() != 0:
+		// the CLI can't mark its sockets, binding the source address the marked
+		// route uses follows the policy as far as the ip rules match on it
+		sourceIP, err = routeSourceIP(family, opts.mark(), opts.netns())
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if sourceIP != "" {
+		args = append(args, "-i", sourceIP)
+	}
+	switch {
+	case b.cfg.ServerID != "":
+		args = append(args, "-s", b.cfg.ServerID)
+	case opts != nil && opts.SpeedtestCliHost != "":
+		args = append(args, "-o", opts.SpeedtestCliHost)
+	}
+	return append(args, "-f", "jsonl", "-p", "yes"), sourceIP, nil
+}
+
+func (b *ooklaCliBackend) Latency(ctx context.Context, report *SpeedReport) error {
+	interfaceOp := b.cfg.InterfaceOp
+	opts := b.cfg.Options
+	args, sourceIP, err := b.args()
+	if err != nil {
+		return err
+	}
+
+	// progress events fill partial, which is what's left when the run is cut short
+	var partial SpeedtestCliResult
+	var result *SpeedtestCliResult
+	var logErr *SpeedtestCliError
+	var phase Phase
+	var last Progress
+	path, args := opts.command(b.path, args)
+	_, err = ExecCmdStream(ctx, path, b.cfg.Timeout, func(line string) {
+		var event SpeedtestCliEvent
+		if json.Unmarshal([]byte(line), &event) != nil {
+			return
+		}
+		p := Progress{NetInterface: interfaceOp, Server: partial.Server.Name}
+		switch event.Type {
+		case "log":
+			if event.Level == "error" {
+				logErr = &SpeedtestCliError{Level: event.Level, Message: event.Message}
+			}
+			return
+		case "result":
+			result = &event.SpeedtestCliResult
+			return
+		case "testStart":
+			partial.Isp = event.Isp
+			partial.Interface = event.Interface
+			partial.Server = event.Server
+			return
+		case "ping":
+			partial.Ping = event.Ping
+			p.Phase = PhaseLatency
+		case "download":
+			partial.Download = event.Download
+			p.Phase = PhaseDownload
+			p.Bytes = event.Download.Bytes
+			p.Elapsed = time.Duration(event.Download.Elapsed) * time.Millisecond
+		case "upload":
+			partial.Upload = event.Upload
+			p.Phase = PhaseUpload
+			p.Bytes = event.Upload.Bytes
+			p.Elapsed = time.Duration(event.Upload.Elapsed) * time.Millisecond
+		default:
+			return
+		}
+		if p.Phase != phase {
+			// announce the phase like the other backends, then report its samples
+			phase = p.Phase
+			last = Progress{}
+			opts.progress(Progress{Phase: phase, NetInterface: interfaceOp, Server: p.Server})
 		}
-		var result SpeedtestCliResult
-		err = json.Unmarshal([]byte(stdout), &result)
-		if err != nil {
-			failedNet = append(failedNet, interfaceOp)
-			continue
+		if p.Phase == PhaseLatency {
+			return
 		}
-		reports = append(reports, transformToReport(result, interfaceOp))
+		if d := (p.Elapsed - last.Elapsed).Seconds(); d > 0 {
+			p.Speed = float64(p.Bytes-last.Bytes) * 8 / 1000 / 1000 / d
+		}
+		last = p
+		opts.progress(p)
+	}, args...)
+	if result == nil {
+		result = &partial
+	}
+	*report = *transformToReport(*result, interfaceOp)
+	if report.NetInterface.InternalIp == "" {
+		report.NetInterface.InternalIp = sourceIP
+	}
+	report.NetInterface.Family = ipFamily(report.NetInterface.InternalIp, opts.family())
+	if ctx.Err() != nil {
+		return ctx.Err()
 	}
-	batchReport.FailedNet = failedNet
-	batchReport.SuccessNet = reports
-	return batchReport, nil
+	if logErr != nil && (err != nil || result == &partial) {
+		logErr.Err = err
+		return logErr
+	}
+	if err != nil {
+		return err
+	}
+	if result == &partial {
+		return errors.New("speedtest cli printed no result")
+	}
+	return nil
+}
+
+func (b *ooklaCliBackend) Upload(ctx context.Context, report *SpeedReport) error {
+	return nil
+}
+
+func (b *ooklaCliBackend) Download(ctx context.Context, report *SpeedReport) error {
+	return nil
+}
+
+func (b *ooklaCliBackend) Close() error {
+	return nil
 }
 
 func transformToReport(cliResult SpeedtestCliResult, interfaceOp string) *SpeedReport {
 	report := &SpeedReport{
-		UploadSpeed:   float64(cliResult.Upload.Bandwidth * 8 / 1000 / 1000),
-		DownloadSpeed: float64(cliResult.Download.Bandwidth * 8 / 1000 / 1000),
+		UploadSpeed:     float64(cliResult.Upload.Bandwidth) * 8 / 1000 / 1000,
+		DownloadSpeed:   float64(cliResult.Download.Bandwidth) * 8 / 1000 / 1000,
+		UploadBytes:     cliResult.Upload.Bytes,
+		DownloadBytes:   cliResult.Download.Bytes,
+		UploadElapsed:   time.Duration(cliResult.Upload.Elapsed) * time.Millisecond,
+		DownloadElapsed: time.Duration(cliResult.Download.Elapsed) * time.Millisecond,
+		// like the native test the latency is half of the round trip, jitter is a
+		// variation between samples and is kept as the CLI measured it
+		Latency:      cliMilliseconds(cliResult.Ping.Latency) / 2,
+		Jitter:       cliMilliseconds(cliResult.Ping.Jitter),
+		Isp:          cliResult.Isp,
+		ResultURL:    cliResult.Result.URL,
+		SpeedtestCli: &cliResult,
+	}
+	if cliResult.PacketLoss != nil {
+		report.PacketLoss = *cliResult.PacketLoss
+	}
+	if cliResult.Server.ID != 0 {
+		report.SpeedtestServer.ID = strconv.Itoa(cliResult.Server.ID)
 	}
 	report.SpeedtestServer.Country = cliResult.Server.Country
 	report.SpeedtestServer.Name = cliResult.Server.Name
+	report.SpeedtestServer.Location = cliResult.Server.Location
+	report.SpeedtestServer.IP = cliResult.Server.IP
+	report.SpeedtestServer.Host = cliResult.Server.Host
+	if cliResult.Server.Host != "" && cliResult.Server.Port != 0 {
+		report.SpeedtestServer.Host = net.JoinHostPort(cliResult.Server.Host, strconv.Itoa(cliResult.Server.Port))
+	}
 	report.SpeedtestServer.Latency = fmt.Sprintf("%+v", cliResult.Ping.Latency)
 	report.NetInterface.Name = interfaceOp
 	report.NetInterface.InternalIp = cliResult.Interface.InternalIP
+	report.NetInterface.ExternalIp = cliResult.Interface.ExternalIP
+	report.NetInterface.MacAddr = cliResult.Interface.MacAddr
+	report.NetInterface.IsVpn = cliResult.Interface.IsVpn
 	return report
 }
+
+func cliMilliseconds(ms float64) time.Duration {
+	return time.Duration(ms * float64(time.Millisecond))
+}
@@ -0,0 +1,190 @@
+package speedtest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const speedtestCliOutput = `{
+	"type": "result",
+	"timestamp": "2024-05-01T10:00:00Z",
+	"ping": {"jitter": 0.5, "latency": 12, "low": 10, "high": 15},
+	"download": {"bandwidth": 12500000, "bytes": 125000000, "elapsed": 10000,
+		"latency": {"iqm": 30, "low": 20, "high": 40, "jitter": 2}},
+	"upload": {"bandwidth": 1250000, "bytes": 12500000, "elapsed": 10000},
+	"packetLoss": 0.5,
+	"isp": "Acme",
+	"interface": {"internalIp": "192.0.2.2", "externalIp": "198.51.100.7", "isVpn": false},
+	"server": {"id": 1234, "name": "lab", "location": "Amsterdam", "country": "NL", "host": "speedtest.example", "port": 8080, "ip": "203.0.113.5"},
+	"result": {"id": "abc", "url": "https://www.speedtest.net/result/c/abc", "persisted": true}
+}`
+
+func TestTransformToReport(t *testing.T) {
+	var result SpeedtestCliResult
+	if err := json.Unmarshal([]byte(speedtestCliOutput), &result); err != nil {
+		t.Fatal(err)
+	}
+	report := transformToReport(result, "eth0")
+	if report.DownloadSpeed != 100 || report.UploadSpeed != 10 {
+		t.Errorf("download %.2f upload %.2f Mbit/s, want 100 and 10", report.DownloadSpeed, report.UploadSpeed)
+	}
+	// the CLI reports round trips, the report keeps one-way latency and the jitter as is
+	if report.Latency != 6*time.Millisecond || report.Jitter != 500*time.Microsecond {
+		t.Errorf("latency %v jitter %v, want 6ms and 500µs", report.Latency, report.Jitter)
+	}
+	if report.SpeedtestServer.Latency != "12" {
+		t.Errorf("server latency = %q, want the CLI's 12", report.SpeedtestServer.Latency)
+	}
+	if s := report.SpeedtestServer; s.ID != "1234" || s.Host != "speedtest.example:8080" || s.IP != "203.0.113.5" {
+		t.Errorf("server = %+v", s)
+	}
+	if report.PacketLoss != 0.5 || report.ResultURL != result.Result.URL {
+		t.Errorf("packet loss %v result %q", report.PacketLoss, report.ResultURL)
+	}
+	if n := report.NetInterface; n.Name != "eth0" || n.InternalIp != "192.0.2.2" || n.ExternalIp != "198.51.100.7" {
+		t.Errorf("interface = %+v", n)
+	}
+	// what has no field of its own is kept in the CLI result
+	cli := report.SpeedtestCli
+	if cli == nil {
+		t.Fatal("no SpeedtestCli in the report")
+	}
+	if cli.Ping.Low != 10 || cli.Ping.High != 15 || cli.Result.ID != "abc" || !cli.Result.Persisted || cli.Timestamp.IsZero() {
+		t.Errorf("cli result = %+v", cli)
+	}
+	if cli.Download.Latency == nil || cli.Download.Latency.Iqm != 30 {
+		t.Errorf("download latency = %+v, want the loaded latency", cli.Download.Latency)
+	}
+}
+
+// what `speedtest -f jsonl -p yes` prints for a complete run
+const speedtestCliEvents = `{"type":"testStart","timestamp":"2024-05-01T10:00:00Z","isp":"Acme","interface":{"internalIp":"192.0.2.2","externalIp":"198.51.100.7"},"server":{"id":1234,"name":"lab","location":"Amsterdam","country":"NL","host":"speedtest.example","port":8080,"ip":"203.0.113.5"}}
+{"type":"ping","timestamp":"2024-05-01T10:00:01Z","ping":{"jitter":0.5,"latency":12,"progress":0.5}}
+{"type":"download","timestamp":"2024-05-01T10:00:02Z","download":{"bandwidth":1000000,"bytes":1000000,"elapsed":1000,"progress":0.5}}
+{"type":"download","timestamp":"2024-05-01T10:00:03Z","download":{"bandwidth":1250000,"bytes":2500000,"elapsed":2000,"progress":1}}
+not json, skipped
+{"type":"upload","timestamp":"2024-05-01T10:00:04Z","upload":{"bandwidth":500000,"bytes":500000,"elapsed":1000,"progress":1}}
+{"type":"result","timestamp":"2024-05-01T10:00:05Z","ping":{"jitter":0.5,"latency":12},"download":{"bandwidth":1250000,"bytes":2500000,"elapsed":2000},"upload":{"bandwidth":500000,"bytes":500000,"elapsed":1000},"isp":"Acme","interface":{"internalIp":"192.0.2.2","externalIp":"198.51.100.7"},"server":{"id":1234,"name":"lab","location":"Amsterdam","country":"NL","host":"speedtest.example","port":8080,"ip":"203.0.113.5"},"result":{"id":"abc","url":"https://www.speedtest.net/result/c/abc","persisted":true}}
+`
+
+// a run the server cuts short: the CLI logs the error and exits 2
+const speedtestCliFailedEvents = `{"type":"testStart","timestamp":"2024-05-01T10:00:00Z","isp":"Acme","server":{"id":1234,"name":"lab"}}
+{"type":"ping","timestamp":"2024-05-01T10:00:01Z","ping":{"jitter":0.5,"latency":12,"progress":1}}
+{"type":"download","timestamp":"2024-05-01T10:00:02Z","download":{"bandwidth":1000000,"bytes":1000000,"elapsed":1000,"progress":0.5}}
+{"type":"log","timestamp":"2024-05-01T10:00:03Z","message":"Cannot read from socket: Connection reset by peer","level":"error"}
+`
+
+// fakeSpeedtestCli puts a speedtest first in PATH that prints events and exits with code
+func fakeSpeedtestCli(t *testing.T, events string, code int) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake speedtest binary is a shell script")
+	}
+	dir := t.TempDir()
+	script := "#!/bin/sh\n" +
+		"case \"$*\" in *--version*) echo 'Speedtest by Ookla 1.2.0.84'; exit 0;; esac\n" +
+		"cat <<'EOF'\n" + events + "EOF\n" +
+		"exit " + strconv.Itoa(code) + "\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "speedtest"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestOoklaCliBackendEvents(t *testing.T) {
+	fakeSpeedtestCli(t, speedtestCliEvents, 0)
+	var samples []Progress
+	var phases []Phase
+	opts := &Options{Backend: OoklaCliBackend, Progress: func(p Progress) {
+		if len(phases) == 0 || phases[len(phases)-1] != p.Phase {
+			phases = append(phases, p.Phase)
+		}
+		if p.Bytes > 0 {
+			samples = append(samples, p)
+		}
+	}}
+	report, err := runTest(context.Background(), BackendConfig{InterfaceOp: "eth0", Timeout: 10, Options: opts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.DownloadBytes != 2500000 || report.DownloadSpeed != 10 || report.UploadBytes != 500000 || report.UploadSpeed != 4 {
+		t.Errorf("download %d bytes %.2f Mbit/s upload %d bytes %.2f Mbit/s, want the result line's", report.DownloadBytes, report.DownloadSpeed, report.UploadBytes, report.UploadSpeed)
+	}
+	if report.Latency != 6*time.Millisecond || report.SpeedtestServer.Name != "lab" || report.ResultURL != "https://www.speedtest.net/result/c/abc" {
+		t.Errorf("latency %v server %q result %q", report.Latency, report.SpeedtestServer.Name, report.ResultURL)
+	}
+
+	wantPhases := []Phase{PhaseServerSelection, PhaseLatency, PhaseDownload, PhaseUpload}
+	if len(phases) < len(wantPhases) {
+		t.Fatalf("phases %v, want %v", phases, wantPhases)
+	}
+	for i, phase := range wantPhases {
+		if phases[i] != phase {
+			t.Fatalf("phases %v, want %v", phases, wantPhases)
+		}
+	}
+	// the speed of a sample is over the bytes since the previous one of its phase
+	want := []Progress{
+		{Phase: PhaseDownload, Bytes: 1000000, Elapsed: time.Second, Speed: 8},
+		{Phase: PhaseDownload, Bytes: 2500000, Elapsed: 2 * time.Second, Speed: 12},
+		{Phase: PhaseUpload, Bytes: 500000, Elapsed: time.Second, Speed: 4},
+	}
+	if len(samples) != len(want) {
+		t.Fatalf("samples %+v, want %+v", samples, want)
+	}
+	for i, p := range samples {
+		if p.Phase != want[i].Phase || p.Bytes != want[i].Bytes || p.Elapsed != want[i].Elapsed || p.Speed != want[i].Speed {
+			t.Errorf("sample %d = %+v, want %+v", i, p, want[i])
+		}
+		if p.NetInterface != "eth0" || p.Server != "lab" {
+			t.Errorf("sample %d from %q to %q, want eth0 and lab", i, p.NetInterface, p.Server)
+		}
+	}
+}
+
+// runOoklaCliBackend runs the steps up to the one running the binary, RunBackend
+// would drop the report of a failed run
+func runOoklaCliBackend(cfg BackendConfig, report *SpeedReport) error {
+	b := &ooklaCliBackend{cfg: cfg}
+	defer b.Close()
+	if err := b.SelectServer(context.Background(), report); err != nil {
+		return err
+	}
+	return b.Latency(context.Background(), report)
+}
+
+// the logged error is returned and the report keeps what the events measured
+func TestOoklaCliBackendError(t *testing.T) {
+	fakeSpeedtestCli(t, speedtestCliFailedEvents, 2)
+	report := &SpeedReport{}
+	err := runOoklaCliBackend(BackendConfig{InterfaceOp: "eth0", Timeout: 10}, report)
+	var cliErr *SpeedtestCliError
+	if !errors.As(err, &cliErr) {
+		t.Fatalf("err = %v, want a *SpeedtestCliError", err)
+	}
+	if cliErr.Level != "error" || cliErr.Message != "Cannot read from socket: Connection reset by peer" {
+		t.Errorf("cli error = %+v", cliErr)
+	}
+	if cliErr.Err == nil || !strings.Contains(cliErr.Err.Error(), "exit code:2") {
+		t.Errorf("cli error wraps %v, want the exit code", cliErr.Err)
+	}
+	if report.DownloadBytes != 1000000 || report.Latency != 6*time.Millisecond || report.SpeedtestServer.Name != "lab" {
+		t.Errorf("partial report: download %d bytes latency %v server %q", report.DownloadBytes, report.Latency, report.SpeedtestServer.Name)
+	}
+}
+
+// a run without result line nor logged error still fails
+func TestOoklaCliBackendNoResult(t *testing.T) {
+	fakeSpeedtestCli(t, strings.SplitAfter(speedtestCliEvents, "\n")[0], 0)
+	if err := runOoklaCliBackend(BackendConfig{Timeout: 10}, &SpeedReport{}); err == nil || !strings.Contains(err.Error(), "no result") {
+		t.Errorf("err = %v, want no result", err)
+	}
+}
@@ -0,0 +1,238 @@
+package speedtest
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Transport picks how the native backend talks to a speedtest.net server
+type Transport int
+
+const (
+	// TransportHTTP uses the legacy latency.txt, random{N}x{N}.jpg and upload.php URLs
+	TransportHTTP Transport = iota
+	// TransportTCP speaks the Ookla TCP protocol (HI, PING, DOWNLOAD, UPLOAD, QUIT)
+	// with the host attribute of the server, like the official clients
+	TransportTCP
+)
+
+func (t Transport) String() string {
+	if t == TransportTCP {
+		return "tcp"
+	}
+	return "http"
+}
+
+const (
+	// the TCP transport always measures for a duration, this one when Options.Duration is not set
+	defaultTCPDuration = 10 * time.Second
+	// DOWNLOAD and UPLOAD sizes start here and double while under 1/16 of the bytes a stream moved
+	minTCPChunk   = 1 << 18
+	maxTCPChunk   = 1 << 26
+	tcpChunkScale = 16
+	// longest line accepted from a peer
+	maxTCPLine = 1024
+)
+
+// ooklaConn is a connection speaking the Ookla TCP protocol, every command is a
+// line answered by a line, except for the payloads of DOWNLOAD and UPLOAD
+type ooklaConn struct {
+	conn    net.Conn
+	br      *bufio.Reader
+	timeout time.Duration
+	done    chan struct{}
+}
+
+// dialOoklaTCP connects to host and greets it, the connection is closed when ctx is done
+func dialOoklaTCP(ctx context.Context, dialer *boundDialer, host string) (*ooklaConn, error) {
+	if host == "" {
+		return nil, errors.New("speedtest server has no tcp host")
+	}
+	conn, err := dialer.dial(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	c := &ooklaConn{
+		conn:    conn,
+		br:      bufio.NewReader(conn),
+		timeout: dialer.Timeout,
+		done:    make(chan struct{}),
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-c.done:
+		}
+	}()
+	reply, err := c.command("HI")
+	if err == nil && !strings.HasPrefix(reply, "HELLO") {
+		err = fmt.Errorf("unexpected greeting %q from %s", reply, host)
+	}
+	if err != nil {
+		c.close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *ooklaConn) deadline() {
+	if c.timeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+}
+
+// command sends line and returns the line answering it
+func (c *ooklaConn) command(line string) (string, error) {
+	c.deadline()
+	if _, err := io.WriteString(c.conn, line+"\n"); err != nil {
+		return "", err
+	}
+	return c.readLine()
+}
+
+func (c *ooklaConn) readLine() (string, error) {
+	line, err := c.br.ReadSlice('\n')
+	if err == bufio.ErrBufferFull || len(line) > maxTCPLine {
+		return "", errors.New("speedtest tcp: line too long")
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(line)), nil
+}
+
+// ping returns the round trip of a PING command
+func (c *ooklaConn) ping() (time.Duration, error) {
+	sTime := time.Now()
+	reply, err := c.command("PING " + strconv.FormatInt(sTime.UnixNano()/int64(time.Millisecond), 10))
+	if err != nil {
+		return 0, err
+	}
+	if !strings.HasPrefix(reply, "PONG") {
+		return 0, fmt.Errorf("unexpected ping reply %q", reply)
+	}
+	return time.Since(sTime), nil
+}
+
+// download asks for size bytes, the reply starts with "DOWNLOAD " and ends with a newline
+func (c *ooklaConn) download(size int64, n *int64) error {
+	c.deadline()
+	if _, err := fmt.Fprintf(c.conn, "DOWNLOAD %d\n", size); err != nil {
+		return err
+	}
+	_, err := io.CopyN(ioutil.Discard, &countingReader{r: c.br, n: n}, size)
+	return err
+}
+
+// upload sends size bytes including the "UPLOAD size 0" line, the server answers
+// "OK size milliseconds" once it read them all
+func (c *ooklaConn) upload(size int64, n *int64) error {
+	c.deadline()
+	header := fmt.Sprintf("UPLOAD %d 0\n", size)
+	if _, err := io.WriteString(c.conn, header); err != nil {
+		return err
+	}
+	body := size - int64(len(header)) - 1
+	if _, err := io.Copy(c.conn, &countingReader{r: newRandomPayload(body), n: n}); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(c.conn, "\n"); err != nil {
+		return err
+	}
+	reply, err := c.readLine()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(reply, "OK") {
+		return fmt.Errorf("unexpected upload reply %q", reply)
+	}
+	return nil
+}
+
+// close says QUIT without waiting for the server
+func (c *ooklaConn) close() {
+	c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	io.WriteString(c.conn, "QUIT\n")
+	close(c.done)
+	c.conn.Close()
+}
+
+// tcpLatencyStats sends pings PING commands over one connection
+func (s *serverItem) tcpLatencyStats(ctx context.Context, dialer *boundDialer, pings int) (*LatencyStats, error) {
+	c, err := dialOoklaTCP(ctx, dialer, s.Host)
+	if err != nil {
+		return nil, err
+	}
+	defer c.close()
+	samples := make([]time.Duration, 0, pings)
+	failed := 0
+	for i := 0; i < pings; i++ {
+		rtt, err := c.ping()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			// a failed command leaves the connection in an unknown state
+			failed += pings - i
+			if len(samples) == 0 {
+				return nil, err
+			}
+			break
+		}
+		samples = append(samples, rtt/2)
+	}
+	return newLatencyStats(samples, failed), nil
+}
+
+// tcpUploadFor uploads on Options.Streams connections for the test duration
+func (s *serverItem) tcpUploadFor(ctx context.Context, dialer *boundDialer, interfaceOp string) (speedMB float64, bytes int64, err error) {
+	p := Progress{Phase: PhaseUpload, NetInterface: interfaceOp, Server: s.Name}
+	return s.opts.runFor(ctx, p, s.tcpDuration(), s.opts.streams(), func(runCtx context.Context, sent *int64) error {
+		return s.tcpStream(runCtx, dialer, sent, (*ooklaConn).upload)
+	})
+}
+
+// tcpDownloadFor downloads on Options.Streams connections for the test duration
+func (s *serverItem) tcpDownloadFor(ctx context.Context, dialer *boundDialer, interfaceOp string) (speedMB float64, bytes int64, err error) {
+	p := Progress{Phase: PhaseDownload, NetInterface: interfaceOp, Server: s.Name}
+	return s.opts.runFor(ctx, p, s.tcpDuration(), s.opts.streams(), func(runCtx context.Context, received *int64) error {
+		return s.tcpStream(runCtx, dialer, received, (*ooklaConn).download)
+	})
+}
+
+// tcpStream repeats transfer on one connection until ctx is done, growing the chunks as it goes
+func (s *serverItem) tcpStream(ctx context.Context, dialer *boundDialer, n *int64, transfer func(c *ooklaConn, size int64, n *int64) error) error {
+	c, err := dialOoklaTCP(ctx, dialer, s.Host)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+	var moved int64
+	size := int64(minTCPChunk)
+	for ctx.Err() == nil {
+		if err := transfer(c, size, n); err != nil {
+			return err
+		}
+		moved += size
+		if size < maxTCPChunk && size < moved/tcpChunkScale {
+			size *= 2
+		}
+	}
+	return nil
+}
+
+func (s *serverItem) tcpDuration() time.Duration {
+	if d := s.opts.duration(); d > 0 {
+		return d
+	}
+	return defaultTCPDuration
+}
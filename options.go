@@ -0,0 +1,206 @@
+package speedtest
+
+import "time"
+
+// parallel requests of a Duration test when Options.Streams is not set
+const defaultStreams = 4
+
+// idle connections kept per host, enough for the largest fixed workload
+const defaultMaxIdleConnsPerHost = 64
+
+// Options changes where and how a speed test runs, a nil *Options keeps the defaults
+type Options struct {
+	// Backend names the registered backend running the test, default NativeBackend
+	Backend string
+
+	// ConfigURL and ServersURL replace the speedtest.net config and server list endpoints
+	ConfigURL  string
+	ServersURL string
+	// Config and Servers are used as they are instead of being fetched
+	Config  *Config
+	Servers []Server
+
+	// Transport is how the native backend reaches a speedtest.net server, TransportHTTP by default
+	Transport Transport
+
+	// LibreSpeedServersURL replaces the public LibreSpeed server list, LibreSpeedServers
+	// is used as it is instead of being fetched
+	LibreSpeedServersURL string
+	LibreSpeedServers    []LibreSpeedServer
+
+	// Iperf3Servers are the "host" or "host:port" targets of the iperf3 backend, Iperf3UDP
+	// tests with UDP at the Iperf3Bandwidth target rate ("100M"), Iperf3Path defaults to iperf3
+	Iperf3Servers   []string
+	Iperf3UDP       bool
+	Iperf3Bandwidth string
+	Iperf3Path      string
+
+	// Ndt7URL is the ws:// or wss:// base of the ndt7 server to test against, by default the
+	// M-Lab locate service, or Ndt7LocateURL when set, picks the nearest one
+	Ndt7URL       string
+	Ndt7LocateURL string
+
+	// CloudflareURL is the base of the __down and __up endpoints of the cloudflare
+	// backend, https://speed.cloudflare.com by default
+	CloudflareURL string
+
+	// SpeedtestCliPath is the Ookla CLI run by the ookla-cli backend, "speedtest" on PATH
+	// by default. SpeedtestCliHost targets a server by host name instead of letting it choose
+	SpeedtestCliPath string
+	SpeedtestCliHost string
+
+	// Duration makes the download and the upload each run for this long, re-issuing
+	// requests on Streams parallel connections and counting the bytes really moved,
+	// instead of sending a fixed workload picked from a warm-up request
+	Duration time.Duration
+	Streams  int
+
+	// Family picks IPv4 or IPv6 for binding the interface and reaching the servers
+	Family IPFamily
+
+	// Mark is the SO_MARK (fwmark) of every socket a test opens, so that ip rules
+	// pick its route. 0 leaves the sockets unmarked, setting one needs linux and CAP_NET_ADMIN
+	Mark uint32
+
+	// Netns runs the whole test inside the named network namespace, one of
+	// /var/run/netns as created by ip netns add. Linux only, entering one needs CAP_SYS_ADMIN.
+	// Names are resolved from inside it with the nameservers of /etc/netns/<name>/resolv.conf
+	// when there is one, search domains and options still come from the host's /etc/resolv.conf.
+	// The iperf3 and Ookla CLI binaries are started through ip netns exec
+	Netns string
+
+	// MaxConnsPerHost limits the connections a test opens to its server, 0 means no limit
+	MaxConnsPerHost int
+	// MaxIdleConnsPerHost is how many connections are kept for reuse between requests, default 64
+	MaxIdleConnsPerHost int
+	// FreshConnections opens a new connection for every request to measure cold-start
+	// throughput, by default a test reuses its connections
+	FreshConnections bool
+
+	// Pings is the number of latency probes sent to the tested server, default 10
+	Pings int
+
+	// Progress is called on every phase change and every ProgressInterval (default 250ms)
+	// during download and upload. Concurrent calls it from several goroutines at once
+	Progress         func(Progress)
+	ProgressInterval time.Duration
+}
+
+func (o *Options) configURL() string {
+	if o == nil || o.ConfigURL == "" {
+		return stConfigUrl
+	}
+	return o.ConfigURL
+}
+
+func (o *Options) serversURL() string {
+	if o == nil || o.ServersURL == "" {
+		return stServersUrl
+	}
+	return o.ServersURL
+}
+
+func (o *Options) duration() time.Duration {
+	if o == nil {
+		return 0
+	}
+	return o.Duration
+}
+
+func (o *Options) streams() int {
+	if o == nil || o.Streams <= 0 {
+		return defaultStreams
+	}
+	return o.Streams
+}
+
+func (o *Options) pings() int {
+	if o == nil || o.Pings <= 0 {
+		return defaultPings
+	}
+	return o.Pings
+}
+
+func (o *Options) family() IPFamily {
+	if o == nil {
+		return FamilyAny
+	}
+	return o.Family
+}
+
+func (o *Options) maxConnsPerHost() int {
+	if o == nil {
+		return 0
+	}
+	return o.MaxConnsPerHost
+}
+
+func (o *Options) maxIdleConnsPerHost() int {
+	if o == nil || o.MaxIdleConnsPerHost <= 0 {
+		return defaultMaxIdleConnsPerHost
+	}
+	return o.MaxIdleConnsPerHost
+}
+
+func (o *Options) freshConnections() bool {
+	return o != nil && o.FreshConnections
+}
+
+func (o *Options) backend() string {
+	if o == nil || o.Backend == "" {
+		return NativeBackend
+	}
+	return o.Backend
+}
+
+func (o *Options) iperf3Path() string {
+	if o == nil || o.Iperf3Path == "" {
+		return "iperf3"
+	}
+	return o.Iperf3Path
+}
+
+func (o *Options) transport() Transport {
+	if o == nil {
+		return TransportHTTP
+	}
+	return o.Transport
+}
+
+func (o *Options) speedtestCliPath() string {
+	if o == nil || o.SpeedtestCliPath == "" {
+		return "speedtest"
+	}
+	return o.SpeedtestCliPath
+}
+
+func (o *Options) mark() uint32 {
+	if o == nil {
+		return 0
+	}
+	return o.Mark
+}
+
+func (o *Options) netns() string {
+	if o == nil {
+		return ""
+	}
+	return o.Netns
+}
+
+// command is the command line that starts path with args, inside Options.Netns when it is set
+func (o *Options) command(path string, args []string) (string, []string) {
+	if o.netns() == "" {
+		return path, args
+	}
+	return "ip", append([]string{"netns", "exec", o.netns(), path}, args...)
+}
+
+// fillRouting records in report how its sockets were routed
+func (o *Options) fillRouting(report *SpeedReport) {
+	if report == nil {
+		return
+	}
+	report.NetInterface.Mark = o.mark()
+	report.NetInterface.Netns = o.netns()
+}
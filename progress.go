@@ -0,0 +1,89 @@
+package speedtest
+
+import (
+	"context"
+	"time"
+)
+
+// Phase is a step of a speed test run
+type Phase string
+
+const (
+	PhaseConfig          Phase = "config"
+	PhaseServerSelection Phase = "server_selection"
+	PhaseLatency         Phase = "latency"
+	PhaseDownload        Phase = "download"
+	PhaseUpload          Phase = "upload"
+)
+
+// default time between two throughput samples
+const defaultProgressInterval = 250 * time.Millisecond
+
+// Progress is sent to Options.Progress when a phase starts and then
+// periodically while data is moved during the download and upload phases
+type Progress struct {
+	Phase        Phase         `json:"phase"`
+	NetInterface string        `json:"net_interface"`
+	Server       string        `json:"server,omitempty"`
+	Bytes        int64         `json:"bytes"`   // moved since the phase started
+	Elapsed      time.Duration `json:"elapsed"` // since the phase started
+	Speed        float64       `json:"speed"`   // Mbps since the previous sample
+}
+
+func (o *Options) progress(p Progress) {
+	if o == nil || o.Progress == nil {
+		return
+	}
+	o.Progress(p)
+}
+
+func (o *Options) progressInterval() time.Duration {
+	if o == nil || o.ProgressInterval <= 0 {
+		return defaultProgressInterval
+	}
+	return o.ProgressInterval
+}
+
+// startSampler announces p.Phase and reports bytes() every progress interval
+// until the returned stop is called, stop sends a last sample
+func (o *Options) startSampler(ctx context.Context, p Progress, bytes func() int64) (stop func()) {
+	o.progress(p)
+	if o == nil || o.Progress == nil {
+		return func() {}
+	}
+	sTime := time.Now()
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	var lastBytes int64
+	lastTime := sTime
+	sample := func() {
+		now := time.Now()
+		p.Bytes = bytes()
+		p.Elapsed = now.Sub(sTime)
+		if d := now.Sub(lastTime).Seconds(); d > 0 {
+			p.Speed = float64(p.Bytes-lastBytes) * 8 / 1000 / 1000 / d
+		}
+		lastBytes, lastTime = p.Bytes, now
+		o.progress(p)
+	}
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(o.progressInterval())
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				sample()
+			case <-ctx.Done():
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+		sample()
+	}
+}
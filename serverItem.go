@@ -1,13 +1,14 @@
 package speedtest
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
-	"net/url"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/sync/errgroup"
@@ -18,139 +19,171 @@ var ulSizes = [...]int{100, 300, 500, 800, 1000, 1500, 2500, 3000, 3500, 4000}
 
 // Server struct is a speedtest candidate server
 type serverItem struct {
-	URL      string
-	Lat      float64
-	Lon      float64
-	Name     string
-	Country  string
-	Sponsor  string
-	ID       string
+	URL     string
+	Lat     float64
+	Lon     float64
+	Name    string
+	Country string
+	Sponsor string
+	ID      string
+	// host:port of the Ookla TCP protocol
+	Host     string
 	Distance float64
 	Latency  time.Duration
+
+	opts *Options
 }
 
 type SpeedResult struct {
 	NetInterfaceName string
 	NetInterfaceIp   string
-	SpeedUpload      float64
-	SpeedDownload    float64
-	Latency          time.Duration
+	// ipv4 or ipv6, empty when neither the source address nor Options.Family decide it
+	NetInterfaceFamily string
+	SpeedUpload        float64
+	SpeedDownload      float64
+	Latency            time.Duration
+	LatencyStats       *LatencyStats
+	// bytes counted while measuring the speed, the warm-up is not included
+	BytesUpload   int64
+	BytesDownload int64
 }
 
 type SpeedReport struct {
-	DownloadSpeed float64       `json:"download_speed"`
-	UploadSpeed   float64       `json:"upload_speed"`
+	DownloadSpeed float64 `json:"download_speed"`
+	UploadSpeed   float64 `json:"upload_speed"`
+	// Latency and LatencyStats are one-way: half of the measured round trip
 	Latency       time.Duration `json:"latency"`
+	LatencyStats  *LatencyStats `json:"latency_stats,omitempty"`
+	DownloadBytes int64         `json:"download_bytes"`
+	UploadBytes   int64         `json:"upload_bytes"`
+	// filled by the backends measuring them. Jitter is the variation between samples
+	// as the backend measured it: the Ookla CLI's ping jitter, or the receiver's
+	// interarrival jitter of an iperf3 UDP test
+	DownloadRetransmits int           `json:"download_retransmits,omitempty"`
+	UploadRetransmits   int           `json:"upload_retransmits,omitempty"`
+	Jitter              time.Duration `json:"jitter,omitempty"`
+	PacketLoss          float64       `json:"packet_loss,omitempty"` // percent
+	DownloadElapsed     time.Duration `json:"download_elapsed,omitempty"`
+	UploadElapsed       time.Duration `json:"upload_elapsed,omitempty"`
+	Isp                 string        `json:"isp,omitempty"`
+	// ResultURL links to the result page of a test published by the Ookla CLI
+	ResultURL string `json:"result_url,omitempty"`
+	// SpeedtestCli is the result the Ookla CLI printed, untouched and in its own
+	// units: milliseconds of round trip and bytes per second
+	SpeedtestCli *SpeedtestCliResult `json:"speedtest_cli,omitempty"`
+	// Error is why the run was cut short, set on the reports of BatchReport.PartialNet
+	Error string `json:"error,omitempty"`
 
 	SpeedtestServer struct {
+		ID       string  `json:"id"`
 		Lat      float64 `json:"lat"`
 		Lon      float64 `json:"lon"`
 		Name     string  `json:"name"`
 		Country  string  `json:"country"`
 		Sponsor  string  `json:"sponsor"`
 		Distance float64 `json:"distance"`
-		Latency  string  `json:"latency"`
+		// round trip in milliseconds as the Ookla CLI printed it, set by that backend
+		Latency string `json:"latency"`
+		// host:port, location and address of the server when the backend knows them
+		Host     string `json:"host,omitempty"`
+		Location string `json:"location,omitempty"`
+		IP       string `json:"ip,omitempty"`
 	} `json:"speedtest_server"`
 	NetInterface struct {
 		Name       string `json:"name"`
 		InternalIp string `json:"internal_ip"`
+		Family     string `json:"family,omitempty"`
+		ExternalIp string `json:"external_ip,omitempty"`
+		MacAddr    string `json:"mac_addr,omitempty"`
+		IsVpn      bool   `json:"is_vpn,omitempty"`
+		// Options.Mark the sockets carried
+		Mark uint32 `json:"mark,omitempty"`
+		// Options.Netns the test ran in
+		Netns string `json:"netns,omitempty"`
 	} `json:"net_interface"`
 }
 
 func (s *serverItem) Report(interfaceOp string, timeout int) (*SpeedReport, error) {
-	report := &SpeedReport{}
-	report.SpeedtestServer.Lat = s.Lat
-	report.SpeedtestServer.Lon = s.Lon
-	report.SpeedtestServer.Name = s.Name
-	report.SpeedtestServer.Country = s.Country
-	report.SpeedtestServer.Sponsor = s.Sponsor
-	result, err := s.StartSpeedTest(interfaceOp, timeout)
-	if err != nil {
-		return nil, err
+	return s.ReportContext(context.Background(), interfaceOp, timeout)
+}
+
+// ReportContext is like Report but stops when ctx is done, in that case the
+// partial report is returned together with ctx.Err()
+func (s *serverItem) ReportContext(ctx context.Context, interfaceOp string, timeout int) (*SpeedReport, error) {
+	b := &nativeBackend{
+		cfg:    BackendConfig{InterfaceOp: interfaceOp, Timeout: timeout, Options: s.opts},
+		server: s,
 	}
-	report.Latency = result.Latency
-	report.DownloadSpeed = result.SpeedDownload
-	report.UploadSpeed = result.SpeedUpload
-	report.NetInterface.Name = result.NetInterfaceName
-	report.NetInterface.InternalIp = result.NetInterfaceIp
-	return report, nil
+	report, err := RunBackend(ctx, b)
+	s.opts.fillRouting(report)
+	return report, err
 }
 
 // test with interfaceOp
 func (s *serverItem) StartSpeedTest(interfaceOp string, timeout int) (*SpeedResult, error) {
-	sourceIP, err := getSourceIP(interfaceOp)
-	if err != nil {
-		return nil, err
-	}
-	latency, err := s.LatencyTest(interfaceOp, timeout)
-	if err != nil {
-		return nil, err
-	}
-	uploadSpeed, err := s.uploadTest(interfaceOp, timeout, latency)
-	if err != nil {
-		return nil, err
-	}
-	downloadSpeed, err := s.downloadTest(interfaceOp, timeout, latency)
-	if err != nil {
+	return s.StartSpeedTestContext(context.Background(), interfaceOp, timeout)
+}
+
+// StartSpeedTestContext is like StartSpeedTest but stops when ctx is done,
+// in that case the partial result is returned together with ctx.Err()
+func (s *serverItem) StartSpeedTestContext(ctx context.Context, interfaceOp string, timeout int) (*SpeedResult, error) {
+	report, err := s.ReportContext(ctx, interfaceOp, timeout)
+	if report == nil {
 		return nil, err
 	}
 	result := &SpeedResult{
-		NetInterfaceName: interfaceOp,
-		NetInterfaceIp:   sourceIP,
-		Latency:          latency,
-		SpeedUpload:      uploadSpeed,
-		SpeedDownload:    downloadSpeed,
+		NetInterfaceName:   report.NetInterface.Name,
+		NetInterfaceIp:     report.NetInterface.InternalIp,
+		NetInterfaceFamily: report.NetInterface.Family,
+		SpeedUpload:        report.UploadSpeed,
+		SpeedDownload:      report.DownloadSpeed,
+		Latency:            report.Latency,
+		LatencyStats:       report.LatencyStats,
+		BytesUpload:        report.UploadBytes,
+		BytesDownload:      report.DownloadBytes,
 	}
-	return result, nil
+	return result, err
 }
 
 func (s *serverItem) LatencyTest(interfaceOp string, timeout int) (latency time.Duration, err error) {
-	pingURL := strings.Split(s.URL, "/upload.php")[0] + "/latency.txt"
-	l := time.Duration(10 * time.Second)
-	for i := 0; i < 3; i++ {
-		sTime := time.Now()
-		req, err := http.NewRequest(http.MethodGet, pingURL, nil)
-		if err != nil {
-			return latency, err
-		}
-		httpUtil, err := getHttpUtil(interfaceOp, timeout)
-		if err != nil {
-			return latency, err
-		}
-		resp, err := httpUtil.Client.Do(req)
-		if err != nil {
-			return latency, err
-		}
-		fTime := time.Now()
-		if fTime.Sub(sTime) < l {
-			l = fTime.Sub(sTime)
-		}
-		resp.Body.Close()
+	return s.LatencyTestContext(context.Background(), interfaceOp, timeout)
+}
+
+// LatencyTestContext is like LatencyTest but the requests are bound to ctx
+func (s *serverItem) LatencyTestContext(ctx context.Context, interfaceOp string, timeout int) (latency time.Duration, err error) {
+	stats, err := s.probeLatency(ctx, interfaceOp, timeout, selectionPings)
+	if err != nil {
+		return latency, err
 	}
-	t := time.Duration(int64(l.Nanoseconds() / 2))
-	return t, nil
+	return stats.Min, nil
 }
 
-func (s *serverItem) uploadTest(interfaceOp string, timeout int, latency time.Duration) (speedMB float64, err error) {
+// on cancellation the speed of the bytes sent so far is returned with ctx.Err()
+func (s *serverItem) uploadTest(ctx context.Context, client *http.Client, interfaceOp string, latency time.Duration) (speedMB float64, bytes int64, err error) {
+	if d := s.opts.duration(); d > 0 {
+		return s.uploadFor(ctx, client, interfaceOp, d, s.opts.streams())
+	}
 	warmSize := ulSizes[4]
 	warmCount := 2
 
+	// the sampler reads the counters until the deferred stop, the results are only set from loads
+	var warmBytes, sent int64
+	stop := s.opts.startSampler(ctx, Progress{Phase: PhaseUpload, NetInterface: interfaceOp, Server: s.Name}, func() int64 {
+		return atomic.LoadInt64(&warmBytes) + atomic.LoadInt64(&sent)
+	})
+	defer stop()
 	sTime := time.Now()
-	eg := errgroup.Group{}
-	for i := 0; i < 2; i++ {
+	eg, egCtx := errgroup.WithContext(ctx)
+	for i := 0; i < warmCount; i++ {
 		eg.Go(func() error {
-			v := url.Values{}
-			v.Add("content", strings.Repeat("0123456789", warmSize*100-51))
-			return upload(s.URL, interfaceOp, timeout, strings.NewReader(v.Encode()))
+			return upload(egCtx, client, s.URL, formContentType, newFormPayload(int64(warmSize)*1000), &warmBytes)
 		})
 	}
 	if err := eg.Wait(); err != nil {
-		return speedMB, err
+		return speedMB, 0, err
 	}
 	fTime := time.Now()
-	// contentSize := float64(warmSize*warmSize*2) / 1000 / 1000 //1.0M
-	contentSize := float64(warmSize*warmSize) / 1000 / 1000 //1.0M
-	warmSpeed := contentSize * 8 * float64(warmCount) / fTime.Sub(sTime.Add(latency)).Seconds()
+	warmSpeed := float64(atomic.LoadInt64(&warmBytes)) * 8 / 1000 / 1000 / fTime.Sub(sTime.Add(latency)).Seconds()
 	workload, weight := 0, 0
 	switch {
 	case 50.0 < warmSpeed:
@@ -165,43 +198,51 @@ func (s *serverItem) uploadTest(interfaceOp string, timeout int, latency time.Du
 		workload, weight = 1, 7
 	}
 	sTime = time.Now()
+	eg, egCtx = errgroup.WithContext(ctx)
 	for i := 0; i < workload; i++ {
 		eg.Go(func() error {
-			v := url.Values{}
-			v.Add("content", strings.Repeat("0123456789", ulSizes[weight]*100-51))
-			return upload(s.URL, interfaceOp, timeout, strings.NewReader(v.Encode()))
+			return upload(egCtx, client, s.URL, formContentType, newFormPayload(int64(ulSizes[weight])*1000), &sent)
 		})
 	}
-	if err := eg.Wait(); err != nil {
-		return speedMB, err
-	}
+	err = eg.Wait()
 	fTime = time.Now()
 
-	reqMB := float64(ulSizes[weight]) / 1000
-	ulSpeed := reqMB * 8 * float64(workload) / fTime.Sub(sTime).Seconds()
-	return ulSpeed, nil
+	bytes = atomic.LoadInt64(&sent)
+	ulSpeed := float64(bytes) * 8 / 1000 / 1000 / fTime.Sub(sTime).Seconds()
+	if err != nil {
+		return partialSpeed(ctx, ulSpeed, bytes, err)
+	}
+	return ulSpeed, bytes, nil
 }
 
-func (s *serverItem) downloadTest(interfaceOp string, timeout int, latency time.Duration) (speedMB float64, err error) {
+// on cancellation the speed of the bytes received so far is returned with ctx.Err()
+func (s *serverItem) downloadTest(ctx context.Context, client *http.Client, interfaceOp string, latency time.Duration) (speedMB float64, bytes int64, err error) {
+	if d := s.opts.duration(); d > 0 {
+		return s.downloadFor(ctx, client, interfaceOp, d, s.opts.streams())
+	}
 	dlURL := strings.Split(s.URL, "/upload.php")[0]
 
+	var warmBytes, received int64
+	stop := s.opts.startSampler(ctx, Progress{Phase: PhaseDownload, NetInterface: interfaceOp, Server: s.Name}, func() int64 {
+		return atomic.LoadInt64(&warmBytes) + atomic.LoadInt64(&received)
+	})
+	defer stop()
 	sTime := time.Now()
-	eg := errgroup.Group{}
+	eg, egCtx := errgroup.WithContext(ctx)
 	warmSize := dlSizes[2]
 	warmCount := 2
 	for i := 0; i < warmCount; i++ {
 		eg.Go(func() error {
 			size := strconv.Itoa(warmSize)
 			url := fmt.Sprintf("%s%s%sx%s.jpg", dlURL, "/random", size, size)
-			return download(url, interfaceOp, timeout)
+			return download(egCtx, client, url, &warmBytes)
 		})
 	}
 	if err := eg.Wait(); err != nil {
-		return speedMB, err
+		return speedMB, 0, err
 	}
 	fTime := time.Now()
-	contentSize := float64(warmSize*warmSize*2) / 1000 / 1000
-	warmSpeed := contentSize * 8 * float64(warmCount) / fTime.Sub(sTime.Add(latency)).Seconds()
+	warmSpeed := float64(atomic.LoadInt64(&warmBytes)) * 8 / 1000 / 1000 / fTime.Sub(sTime.Add(latency)).Seconds()
 	workload, weight := 0, 0
 	switch {
 	case 50.0 < warmSpeed:
@@ -215,20 +256,82 @@ func (s *serverItem) downloadTest(interfaceOp string, timeout int, latency time.
 	default:
 		workload, weight = 6, 3
 	}
+	sTime = time.Now()
+	eg, egCtx = errgroup.WithContext(ctx)
 	for i := 0; i < workload; i++ {
 		eg.Go(func() error {
 			size := strconv.Itoa(dlSizes[weight])
 			url := fmt.Sprintf("%s%s%sx%s.jpg", dlURL, "/random", size, size)
-			return download(url, interfaceOp, timeout)
+			return download(egCtx, client, url, &received)
 		})
 	}
-	if err := eg.Wait(); err != nil {
-		return speedMB, err
-	}
+	err = eg.Wait()
 	fTime = time.Now()
-	reqMB := dlSizes[weight] * dlSizes[weight] * 2 / 1000 / 1000
-	dlSpeed := float64(reqMB) * 8 * float64(workload) / fTime.Sub(sTime).Seconds()
-	return dlSpeed, nil
+	bytes = atomic.LoadInt64(&received)
+	dlSpeed := float64(bytes) * 8 / 1000 / 1000 / fTime.Sub(sTime).Seconds()
+	if err != nil {
+		return partialSpeed(ctx, dlSpeed, bytes, err)
+	}
+	return dlSpeed, bytes, nil
+}
+
+// upload with streams parallel requests for d, each stream posts again as soon as its request is done
+func (s *serverItem) uploadFor(ctx context.Context, client *http.Client, interfaceOp string, d time.Duration, streams int) (speedMB float64, bytes int64, err error) {
+	p := Progress{Phase: PhaseUpload, NetInterface: interfaceOp, Server: s.Name}
+	return s.opts.runFor(ctx, p, d, streams, func(runCtx context.Context, sent *int64) error {
+		return upload(runCtx, client, s.URL, formContentType, newFormPayload(int64(ulSizes[9])*1000), sent)
+	})
+}
+
+// download with streams parallel requests for d, each stream fetches again as soon as its request is done
+func (s *serverItem) downloadFor(ctx context.Context, client *http.Client, interfaceOp string, d time.Duration, streams int) (speedMB float64, bytes int64, err error) {
+	size := strconv.Itoa(dlSizes[9])
+	url := fmt.Sprintf("%s%s%sx%s.jpg", strings.Split(s.URL, "/upload.php")[0], "/random", size, size)
+	p := Progress{Phase: PhaseDownload, NetInterface: interfaceOp, Server: s.Name}
+	return s.opts.runFor(ctx, p, d, streams, func(runCtx context.Context, received *int64) error {
+		return download(runCtx, client, url, received)
+	})
+}
+
+// runFor repeats transfer on streams goroutines until d elapsed, transfer adds the
+// bytes it moves to the counter, the speed is computed from the counted bytes
+func (o *Options) runFor(ctx context.Context, p Progress, d time.Duration, streams int, transfer func(runCtx context.Context, n *int64) error) (speedMB float64, bytes int64, err error) {
+	runCtx, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+	stop := o.startSampler(ctx, p, func() int64 {
+		return atomic.LoadInt64(&bytes)
+	})
+	sTime := time.Now()
+	eg, egCtx := errgroup.WithContext(runCtx)
+	for i := 0; i < streams; i++ {
+		eg.Go(func() error {
+			for egCtx.Err() == nil {
+				if err := transfer(egCtx, &bytes); err != nil && egCtx.Err() == nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	err = eg.Wait()
+	fTime := time.Now()
+	stop()
+	bytes = atomic.LoadInt64(&bytes)
+	speed := float64(bytes) * 8 / 1000 / 1000 / fTime.Sub(sTime).Seconds()
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		return partialSpeed(ctx, speed, bytes, err)
+	}
+	return speed, bytes, nil
+}
+
+func partialSpeed(ctx context.Context, speedMB float64, bytes int64, err error) (float64, int64, error) {
+	if ctx.Err() != nil {
+		return speedMB, bytes, ctx.Err()
+	}
+	return 0, 0, err
 }
 
 // ByDistance allows us to sort servers by distance
@@ -261,40 +364,70 @@ func (server latency) Swap(i, j int) {
 	server[i], server[j] = server[j], server[i]
 }
 
-func upload(uploadUrl, interfaceOp string, timeout int, body io.Reader) error {
-	req, err := http.NewRequest(http.MethodPost, uploadUrl, body)
+// upload posts body as contentType and adds the bytes the server accepted to n. Bytes are
+// added while they are sent and corrected down when the server reports a smaller size
+func upload(ctx context.Context, client *http.Client, uploadUrl, contentType string, body io.Reader, n *int64) error {
+	sent := &countingReader{r: body, n: n}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uploadUrl, sent)
 	if err != nil {
 		return err
 	}
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	httpUtil, err := getHttpUtil(interfaceOp, timeout)
+	// NewRequest can't see the length through the counting wrapper
+	if l, ok := body.(interface{ Len() int }); ok {
+		req.ContentLength = int64(l.Len())
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := client.Do(req)
 	if err != nil {
 		return err
 	}
-	resp, err := httpUtil.Client.Do(req)
+	defer resp.Body.Close()
+	if err := checkStatus(resp); err != nil {
+		return err
+	}
+	reply, err := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
+	// upload.php answers size=N with the number of bytes it read
+	if accepted, ok := uploadedSize(string(reply)); ok && accepted < sent.Total() {
+		atomic.AddInt64(n, accepted-sent.Total())
+	}
 	_, err = io.Copy(ioutil.Discard, resp.Body)
 	return err
 }
 
-func download(url, interfaceOp string, timeout int) error {
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+// download fetches url and adds the received body bytes to n
+func download(ctx context.Context, client *http.Client, url string, n *int64) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return err
 	}
-	httpUtil, err := getHttpUtil(interfaceOp, timeout)
+	resp, err := client.Do(req)
 	if err != nil {
 		return err
 	}
-
-	resp, err := httpUtil.Client.Do(req)
-	if err != nil {
+	defer resp.Body.Close()
+	if err := checkStatus(resp); err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-	_, err = io.Copy(ioutil.Discard, resp.Body)
+	_, err = io.Copy(ioutil.Discard, &countingReader{r: resp.Body, n: n})
 	return err
 }
+
+func uploadedSize(reply string) (int64, bool) {
+	reply = strings.TrimSpace(reply)
+	if !strings.HasPrefix(reply, "size=") {
+		return 0, false
+	}
+	size, err := strconv.ParseInt(strings.TrimPrefix(reply, "size="), 10, 64)
+	return size, err == nil
+}
+
+// any 2xx is a success, plain URLs answer uploads with 201 or 204 and ranges with 206
+func checkStatus(resp *http.Response) error {
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s %s: %s", resp.Request.Method, resp.Request.URL, resp.Status)
+	}
+	return nil
+}
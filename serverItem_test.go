@@ -0,0 +1,69 @@
+package speedtest
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// the native backend posts the form legacy upload.php servers get, the Handler counts all of it
+func TestUploadForm(t *testing.T) {
+	const size = 100000
+	var contentType, content string
+	handler := &Handler{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		if r.URL.Query().Get("parse") == "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		content = r.PostForm.Get("content")
+	}))
+	defer ts.Close()
+
+	var n int64
+	if err := upload(context.Background(), ts.Client(), ts.URL+"/upload.php", formContentType, newFormPayload(size), &n); err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "application/x-www-form-urlencoded" {
+		t.Errorf("content type = %q, want the form encoding", contentType)
+	}
+	// n is corrected down when upload.php answers a smaller size=
+	if n != size {
+		t.Errorf("the handler accepted %d of %d bytes", n, size)
+	}
+
+	if err := upload(context.Background(), ts.Client(), ts.URL+"/upload.php?parse=1", formContentType, newFormPayload(size), &n); err != nil {
+		t.Fatal(err)
+	}
+	if len(content) != size-len("content=") || strings.Trim(content, formAlphabet) != "" {
+		t.Errorf("form field content = %d bytes outside the URL-safe alphabet or of the wrong size", len(content))
+	}
+}
+
+func TestFormPayloadSize(t *testing.T) {
+	for _, size := range []int64{0, 3, 8, 9, 1 << 16} {
+		p := newFormPayload(size)
+		if p.Len() != int(size) {
+			t.Errorf("newFormPayload(%d).Len() = %d", size, p.Len())
+		}
+		var read int64
+		b := make([]byte, 5)
+		for {
+			n, err := p.Read(b)
+			read += int64(n)
+			if err != nil {
+				break
+			}
+		}
+		if read != size {
+			t.Errorf("newFormPayload(%d) read %d bytes", size, read)
+		}
+	}
+}
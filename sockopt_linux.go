@@ -0,0 +1,38 @@
+package speedtest
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// socketControl is the Control hook of a boundDialer. SO_MARK tags the packets
+// for policy routing, it needs CAP_NET_ADMIN and fails the dial without it.
+// SO_BINDTODEVICE makes the socket leave through device whatever the routing
+// table says, without CAP_NET_RAW the kernel refuses it and the source address
+// binding alone remains
+func socketControl(device string, mark uint32) func(network, address string, c syscall.RawConn) error {
+	if device == "" && mark == 0 {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			if mark != 0 {
+				if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, int(mark)); err != nil {
+					sockErr = fmt.Errorf("set socket mark %#x: %w", mark, err)
+					return
+				}
+			}
+			if device != "" {
+				err := syscall.BindToDevice(int(fd), device)
+				if err != nil && err != syscall.EPERM && err != syscall.EACCES {
+					sockErr = err
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
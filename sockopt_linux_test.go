@@ -0,0 +1,96 @@
+package speedtest
+
+import (
+	"context"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestSocketControlNothingAsked(t *testing.T) {
+	if socketControl("", 0) != nil {
+		t.Error("a Control hook without a device or a mark")
+	}
+}
+
+// an interface name binds the sockets to the device, an address only binds the source.
+// Without CAP_NET_RAW the device binding is skipped and the dial still works
+func TestDialerBindsDevice(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	tests := []struct {
+		interfaceOp, device string
+	}{
+		{"lo", "lo"},
+		{"127.0.0.1", ""},
+	}
+	for _, tt := range tests {
+		dialer, err := getDialer(tt.interfaceOp, 5, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dialer.device != tt.device || dialer.sourceIP != "127.0.0.1" || (dialer.Control == nil) != (tt.device == "") {
+			t.Errorf("%s: device %q source %q, want device %q from 127.0.0.1", tt.interfaceOp, dialer.device, dialer.sourceIP, tt.device)
+		}
+		conn, err := dialer.dial(context.Background(), l.Addr().String())
+		if err != nil {
+			t.Errorf("%s: %v", tt.interfaceOp, err)
+			continue
+		}
+		conn.Close()
+	}
+}
+
+// SO_MARK needs CAP_NET_ADMIN, without it the dial fails instead of leaving unmarked
+func TestDialerMark(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	dialer, err := getDialer("", 5, &Options{Mark: 0x2a})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.dial(context.Background(), l.Addr().String())
+	if err != nil {
+		if !strings.Contains(err.Error(), "set socket mark 0x2a") {
+			t.Errorf("dial = %v, want the socket mark error", err)
+		}
+		return
+	}
+	defer conn.Close()
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mark int
+	raw.Control(func(fd uintptr) {
+		mark, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK)
+	})
+	if err != nil || mark != 0x2a {
+		t.Errorf("socket mark = %#x, %v, want 0x2a", mark, err)
+	}
+}
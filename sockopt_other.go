@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package speedtest
+
+import (
+	"errors"
+	"syscall"
+)
+
+// binding to a device is linux only, elsewhere the source address binding is
+// all there is. A socket mark can't be honoured so it fails the dial
+func socketControl(device string, mark uint32) func(network, address string, c syscall.RawConn) error {
+	if mark == 0 {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		return errors.New("socket marks are only supported on linux")
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+package speedtest
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestSocketControlMark(t *testing.T) {
+	if socketControl("eth0", 0) != nil {
+		t.Error("a Control hook for a device binding that can't be done")
+	}
+	dialer, err := getDialer("", 5, &Options{Mark: 0x2a})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dialer.dial(context.Background(), "127.0.0.1:9")
+	if err == nil || !strings.Contains(err.Error(), "socket marks are only supported on linux") {
+		t.Errorf("dial = %v, want the socket mark error", err)
+	}
+}
@@ -1,124 +1,268 @@
 package speedtest
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"sync"
 )
 
 // speedtest by distance
 func ByDistance(interfaceOp string, httpTimeout int) (*SpeedReport, error) {
-	st, err := initStClient(interfaceOp, httpTimeout)
-	if err != nil {
-		return nil, err
-	}
-	servers, err := st.FetchServerList()
-	if err != nil {
-		return nil, err
-	}
-	servers, err = st.ServerListByDistance(servers)
-	if err != nil {
-		return nil, err
-	}
-	if len(servers) == 0 {
-		return nil, errors.New("not found speedtest server")
-	}
-	nearest := servers[0]
-	return nearest.Report(interfaceOp, httpTimeout)
+	return ByDistanceContext(context.Background(), interfaceOp, httpTimeout)
+}
+
+// ByDistanceContext is like ByDistance but stops when ctx is done, a report
+// started before that is returned partially filled together with ctx.Err()
+func ByDistanceContext(ctx context.Context, interfaceOp string, httpTimeout int) (*SpeedReport, error) {
+	return ByDistanceWithOptions(ctx, interfaceOp, httpTimeout, nil)
+}
+
+// ByDistanceWithOptions is like ByDistanceContext, opts may be nil
+func ByDistanceWithOptions(ctx context.Context, interfaceOp string, httpTimeout int, opts *Options) (*SpeedReport, error) {
+	return runTest(ctx, BackendConfig{
+		InterfaceOp: interfaceOp,
+		Timeout:     httpTimeout,
+		Options:     opts,
+	})
 }
 
 // speedtest by latency
 func ByLatency(interfaceOp string, httpTimeout int) (*SpeedReport, error) {
-	st, err := initStClient(interfaceOp, httpTimeout)
-	if err != nil {
-		return nil, err
-	}
-	servers, err := st.FetchServerList()
-	if err != nil {
-		return nil, err
-	}
-	servers, err = st.ServerListByLatency(servers)
-	if err != nil {
-		return nil, err
-	}
-	if len(servers) == 0 {
-		return nil, errors.New("not found speedtest server")
-	}
-	fastServer := servers[0]
+	return ByLatencyContext(context.Background(), interfaceOp, httpTimeout)
+}
+
+// ByLatencyContext is like ByLatency but stops when ctx is done, a report
+// started before that is returned partially filled together with ctx.Err()
+func ByLatencyContext(ctx context.Context, interfaceOp string, httpTimeout int) (*SpeedReport, error) {
+	return ByLatencyWithOptions(ctx, interfaceOp, httpTimeout, nil)
+}
 
-	return fastServer.Report(interfaceOp, httpTimeout)
+// ByLatencyWithOptions is like ByLatencyContext, opts may be nil
+func ByLatencyWithOptions(ctx context.Context, interfaceOp string, httpTimeout int, opts *Options) (*SpeedReport, error) {
+	return runTest(ctx, BackendConfig{
+		InterfaceOp: interfaceOp,
+		Timeout:     httpTimeout,
+		IsLatency:   true,
+		Options:     opts,
+	})
+}
+
+// speedtest against the server with the given id from the server list
+func ByServerID(interfaceOp string, httpTimeout int, id string) (*SpeedReport, error) {
+	return ByServerIDWithOptions(context.Background(), interfaceOp, httpTimeout, id, nil)
+}
+
+// ByServerIDWithOptions is like ByServerID but stops when ctx is done, opts may be nil
+func ByServerIDWithOptions(ctx context.Context, interfaceOp string, httpTimeout int, id string, opts *Options) (*SpeedReport, error) {
+	return runTest(ctx, BackendConfig{
+		InterfaceOp: interfaceOp,
+		Timeout:     httpTimeout,
+		ServerID:    id,
+		Options:     opts,
+	})
 }
 
 type BatchReport struct {
 	SuccessNet []*SpeedReport `json:"success_net"`
 	FailedNet  []string       `json:"failed_net"`
+	// PartialNet keeps what the runs listed in FailedNet measured before
+	// they failed or were cancelled, with the reason in SpeedReport.Error
+	PartialNet []*SpeedReport `json:"partial_net,omitempty"`
+}
+
+// add files the run of name: a complete report goes to SuccessNet, a run that
+// ended with err is listed in FailedNet and what it measured kept in PartialNet
+func (b *BatchReport) add(name string, report *SpeedReport, err error) {
+	switch {
+	case err == nil && report != nil:
+		b.SuccessNet = append(b.SuccessNet, report)
+	case err == nil:
+	case report != nil:
+		report.Error = err.Error()
+		b.FailedNet = append(b.FailedNet, name)
+		b.PartialNet = append(b.PartialNet, report)
+	default:
+		b.FailedNet = append(b.FailedNet, name)
+	}
 }
 
 // useless for test ,limit by speedtest server
 func Concurrent(interfaceOps []string, httpTimeout int, isLatency bool) (*BatchReport, error) {
+	return ConcurrentContext(context.Background(), interfaceOps, httpTimeout, isLatency)
+}
+
+// ConcurrentContext is like Concurrent but stops when ctx is done, reports
+// finished before that are kept in SuccessNet, partially measured ones in PartialNet
+func ConcurrentContext(ctx context.Context, interfaceOps []string, httpTimeout int, isLatency bool) (*BatchReport, error) {
+	return ConcurrentWithOptions(ctx, interfaceOps, httpTimeout, isLatency, nil)
+}
+
+// ConcurrentWithOptions is like ConcurrentContext, opts may be nil. With a backend other than
+// NativeBackend each interface is tested on the server its backend picks
+func ConcurrentWithOptions(ctx context.Context, interfaceOps []string, httpTimeout int, isLatency bool, opts *Options) (*BatchReport, error) {
 	if len(interfaceOps) == 0 {
 		return nil, errors.New("interfaceOps less 1")
 	}
-	st, err := initStClient(interfaceOps[0], httpTimeout)
-	if err != nil {
-		return nil, err
+	if opts.backend() != NativeBackend {
+		return batchTest(ctx, interfaceOps, httpTimeout, isLatency, opts, true)
 	}
-	servers, err := st.FetchServerList()
+	targetServer, err := fastServers(ctx, interfaceOps[0], httpTimeout, isLatency, 1, opts)
 	if err != nil {
 		return nil, err
 	}
-	if isLatency {
-		servers, err = st.ServerListByLatency(servers)
-	} else {
-		servers, err = st.ServerListByDistance(servers)
-	}
-	if err != nil {
-		return nil, err
-	}
-	if len(servers) == 0 {
-		return nil, errors.New("not found speedtest server")
-	}
-	targetServer := servers[0]
 	var mu sync.Mutex
 	var wg sync.WaitGroup
-	var reports []*SpeedReport
-	var failedNet []string
+	batchReport := &BatchReport{}
 	for i := range interfaceOps {
 		wg.Add(1)
 		go func(s *serverItem, interfaceOp string, httpTimeout int) {
-			report, err := s.Report(interfaceOp, httpTimeout)
+			report, err := s.ReportContext(ctx, interfaceOp, httpTimeout)
 			mu.Lock()
-			if err != nil {
-				failedNet = append(failedNet, interfaceOp)
-			} else {
-				reports = append(reports, report)
-			}
+			batchReport.add(interfaceOp, report, err)
 			mu.Unlock()
 			wg.Done()
-		}(targetServer, interfaceOps[i], httpTimeout)
+		}(targetServer[0], interfaceOps[i], httpTimeout)
 	}
 	wg.Wait()
-	batchReport := &BatchReport{
-		SuccessNet: reports,
-		FailedNet:  failedNet,
-	}
-	return batchReport, nil
+	return batchReport, ctx.Err()
 }
 
 // speedtest one by one with config eth name
 func OnebyOne(interfaceOps []string, httpTimeout int, isLatency bool, testNum int) (*BatchReport, error) {
+	return OnebyOneContext(context.Background(), interfaceOps, httpTimeout, isLatency, testNum)
+}
+
+// OnebyOneContext is like OnebyOne but stops when ctx is done, interfaces
+// measured before that are kept in the returned report, a cut short one in PartialNet
+func OnebyOneContext(ctx context.Context, interfaceOps []string, httpTimeout int, isLatency bool, testNum int) (*BatchReport, error) {
+	return OnebyOneWithOptions(ctx, interfaceOps, httpTimeout, isLatency, testNum, nil)
+}
+
+// OnebyOneWithOptions is like OnebyOneContext, opts may be nil. With a backend other than
+// NativeBackend each interface gets a single run on the server its backend picks, testNum is ignored
+func OnebyOneWithOptions(ctx context.Context, interfaceOps []string, httpTimeout int, isLatency bool, testNum int, opts *Options) (*BatchReport, error) {
 	if len(interfaceOps) == 0 {
 		return nil, errors.New("interfaceOps less 1")
 	}
-	st, err := initStClient(interfaceOps[0], httpTimeout)
+	if opts.backend() != NativeBackend {
+		return batchTest(ctx, interfaceOps, httpTimeout, isLatency, opts, false)
+	}
+	testServers, err := fastServers(ctx, interfaceOps[0], httpTimeout, isLatency, testNum, opts)
 	if err != nil {
 		return nil, err
 	}
-	servers, err := st.FetchServerList()
+	batchReport := &BatchReport{}
+	for i := range interfaceOps {
+		var maxSpeedReport, partial *SpeedReport
+		var partialErr error
+		for j := range testServers {
+			fastServer := testServers[j]
+			report, err := fastServer.ReportContext(ctx, interfaceOps[i], httpTimeout)
+			if err != nil {
+				// a cut short run only counts when no server completed
+				if report != nil && partial == nil {
+					partial, partialErr = report, err
+				}
+			} else if maxSpeedReport == nil || maxSpeedReport.UploadSpeed < report.UploadSpeed {
+				maxSpeedReport = report
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		switch {
+		case maxSpeedReport == nil && partial != nil:
+			batchReport.add(interfaceOps[i], partial, partialErr)
+		case maxSpeedReport == nil || maxSpeedReport.UploadSpeed < 1: //小于1M 则直接认为是失败
+			batchReport.FailedNet = append(batchReport.FailedNet, interfaceOps[i])
+		default:
+			batchReport.SuccessNet = append(batchReport.SuccessNet, maxSpeedReport)
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return batchReport, ctx.Err()
+}
+
+// ByMarks runs one test per socket mark, one after the other, so that a router
+// steering its uplinks with fwmarks and ip rules gets a report per routing policy.
+// Each run uses opts with Mark set, a report carries its mark in NetInterface.Mark
+// and the marks that failed are listed in FailedNet as hex numbers
+func ByMarks(ctx context.Context, interfaceOp string, httpTimeout int, isLatency bool, marks []uint32, opts *Options) (*BatchReport, error) {
+	if len(marks) == 0 {
+		return nil, errors.New("marks less 1")
+	}
+	batchReport := &BatchReport{}
+	for _, mark := range marks {
+		if ctx.Err() != nil {
+			break
+		}
+		markOpts := Options{}
+		if opts != nil {
+			markOpts = *opts
+		}
+		markOpts.Mark = mark
+		report, err := runTest(ctx, BackendConfig{
+			InterfaceOp: interfaceOp,
+			Timeout:     httpTimeout,
+			IsLatency:   isLatency,
+			Options:     &markOpts,
+		})
+		batchReport.add(fmt.Sprintf("%#x", mark), report, err)
+	}
+	return batchReport, ctx.Err()
+}
+
+// test every interface with its own run of the backend picked by opts, each
+// backend chooses its servers itself
+func batchTest(ctx context.Context, interfaceOps []string, httpTimeout int, isLatency bool, opts *Options, concurrent bool) (*BatchReport, error) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	batchReport := &BatchReport{}
+	test := func(interfaceOp string) {
+		report, err := runTest(ctx, BackendConfig{
+			InterfaceOp: interfaceOp,
+			Timeout:     httpTimeout,
+			IsLatency:   isLatency,
+			Options:     opts,
+		})
+		mu.Lock()
+		batchReport.add(interfaceOp, report, err)
+		mu.Unlock()
+	}
+	for _, interfaceOp := range interfaceOps {
+		if ctx.Err() != nil {
+			break
+		}
+		if !concurrent {
+			test(interfaceOp)
+			continue
+		}
+		wg.Add(1)
+		go func(interfaceOp string) {
+			defer wg.Done()
+			test(interfaceOp)
+		}(interfaceOp)
+	}
+	wg.Wait()
+	return batchReport, ctx.Err()
+}
+
+// fetch the server list through interfaceOp and keep the first testNum servers,
+// testNum less than 0 keeps all of them
+func fastServers(ctx context.Context, interfaceOp string, httpTimeout int, isLatency bool, testNum int, opts *Options) ([]*serverItem, error) {
+	st, err := initStClient(ctx, interfaceOp, httpTimeout, opts)
+	if err != nil {
+		return nil, err
+	}
+	servers, err := st.FetchServerListContext(ctx)
 	if err != nil {
 		return nil, err
 	}
 	if isLatency {
-		servers, err = st.ServerListByLatency(servers)
+		servers, err = st.ServerListByLatencyContext(ctx, servers)
 	} else {
 		servers, err = st.ServerListByDistance(servers)
 	}
@@ -131,33 +275,5 @@ func OnebyOne(interfaceOps []string, httpTimeout int, isLatency bool, testNum in
 	if testNum < 0 || len(servers) < testNum {
 		testNum = len(servers)
 	}
-	testServers := make([]*serverItem, testNum)
-	for i := 0; i < testNum; i++ { // fast server
-		testServers[i] = servers[i]
-	}
-	var reports []*SpeedReport
-	var failedNet []string
-	for i := range interfaceOps {
-		var maxSpeedReport *SpeedReport
-		for j := range testServers {
-			fastServer := testServers[j]
-			report, err := fastServer.Report(interfaceOps[i], httpTimeout)
-			if err != nil {
-				continue
-			}
-			if maxSpeedReport.UploadSpeed < report.UploadSpeed {
-				maxSpeedReport = report
-			}
-		}
-		if maxSpeedReport.UploadSpeed < 1 { //小于1M 则直接认为是失败
-			failedNet = append(failedNet, interfaceOps[i])
-		} else {
-			reports = append(reports, maxSpeedReport)
-		}
-	}
-	batchReport := &BatchReport{
-		SuccessNet: reports,
-		FailedNet:  failedNet,
-	}
-	return batchReport, nil
+	return servers[:testNum], nil
 }
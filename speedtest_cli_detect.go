@@ -0,0 +1,114 @@
+package speedtest
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// oldest Ookla CLI speaking jsonl
+const minSpeedtestCliVersion = "1.0.0"
+
+// seconds given to `speedtest --version`
+const speedtestCliDetectTimeout = 10
+
+var (
+	ooklaCliVersion  = regexp.MustCompile(`Speedtest by Ookla ([0-9][0-9.]*)`)
+	pythonCliVersion = regexp.MustCompile(`speedtest-cli ([0-9][0-9.]*)`)
+)
+
+// SpeedtestCliInfo describes the binary found by DetectSpeedtestCli
+type SpeedtestCliInfo struct {
+	Path    string `json:"path"`
+	Version string `json:"version"`
+	// Official is false for the Python speedtest-cli, which the ookla-cli backend can't run
+	Official bool `json:"official"`
+}
+
+// SpeedtestCliUnavailableError tells why the ookla-cli backend can't run
+type SpeedtestCliUnavailableError struct {
+	Path   string
+	Reason string
+	Err    error
+}
+
+func (e *SpeedtestCliUnavailableError) Error() string {
+	msg := fmt.Sprintf("speedtest cli %s unavailable: %s", e.Path, e.Reason)
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *SpeedtestCliUnavailableError) Unwrap() error {
+	return e.Err
+}
+
+// DetectSpeedtestCli finds path, "speedtest" on PATH when empty, and asks it
+// for its version. The Python speedtest-cli and Ookla CLIs older than 1.0 are
+// reported as a *SpeedtestCliUnavailableError together with what was found
+func DetectSpeedtestCli(ctx context.Context, path string) (*SpeedtestCliInfo, error) {
+	if path == "" {
+		path = "speedtest"
+	}
+	resolved, err := exec.LookPath(path)
+	if err != nil {
+		return nil, &SpeedtestCliUnavailableError{Path: path, Reason: "not found", Err: err}
+	}
+	info := &SpeedtestCliInfo{Path: resolved}
+	stdout, stderr, err := ExecCmdContext(ctx, resolved, speedtestCliDetectTimeout, "--version")
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	output := stdout + "\n" + stderr
+	if m := ooklaCliVersion.FindStringSubmatch(output); m != nil {
+		info.Version = m[1]
+		info.Official = true
+	} else if m := pythonCliVersion.FindStringSubmatch(output); m != nil {
+		info.Version = m[1]
+		return info, &SpeedtestCliUnavailableError{Path: resolved, Reason: "python speedtest-cli " + info.Version + " found, the Ookla CLI is needed"}
+	} else {
+		if err == nil {
+			err = fmt.Errorf("unrecognized version %q", strings.TrimSpace(output))
+		}
+		return nil, &SpeedtestCliUnavailableError{Path: resolved, Reason: "not a speedtest cli", Err: err}
+	}
+	if compareVersions(info.Version, minSpeedtestCliVersion) < 0 {
+		return info, &SpeedtestCliUnavailableError{Path: resolved, Reason: "version " + info.Version + " is older than " + minSpeedtestCliVersion}
+	}
+	return info, nil
+}
+
+// compareVersions compares dotted numeric versions, missing parts count as 0
+// and a part is read up to its first non-digit, so 1.2.0-beta is 1.2.0
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x = versionPart(as[i])
+		}
+		if i < len(bs) {
+			y = versionPart(bs[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func versionPart(part string) int {
+	end := strings.IndexFunc(part, func(r rune) bool { return r < '0' || r > '9' })
+	if end >= 0 {
+		part = part[:end]
+	}
+	n, _ := strconv.Atoi(part)
+	return n
+}
@@ -0,0 +1,77 @@
+package speedtest
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.2.0", "1.2.0", 0},
+		{"1.2.0", "1.10", -1},
+		{"1.10", "1.2.0", 1},
+		{"1.2", "1.2.0", 0},
+		{"1.2.0.1", "1.2", 1},
+		{"1", "1.0.1", -1},
+		{"0.9.9", "1.0.0", -1},
+		{"1.2.0-beta", "1.2.0", 0},
+		{"1.10rc1", "1.9", 1},
+		{"", "0", 0},
+	}
+	for _, tt := range tests {
+		if got := compareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestDetectSpeedtestCli(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake speedtest binaries are shell scripts")
+	}
+	tests := []struct {
+		name     string
+		output   string
+		version  string
+		official bool
+		// the reason of the *SpeedtestCliUnavailableError, empty when the binary is usable
+		reason string
+	}{
+		{"ookla", "Speedtest by Ookla 1.2.0.84 (ea6b6773cf) Linux/x86_64-linux-musl", "1.2.0.84", true, ""},
+		{"ookla old", "Speedtest by Ookla 0.9.3", "0.9.3", true, "version 0.9.3 is older than 1.0.0"},
+		{"python", "speedtest-cli 2.1.3\nPython 3.11.2", "2.1.3", false, "python speedtest-cli 2.1.3 found, the Ookla CLI is needed"},
+		{"other", "something else 1.0", "", false, "not a speedtest cli"},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.name)
+		script := "#!/bin/sh\ncat <<'EOF'\n" + tt.output + "\nEOF\n"
+		if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+		info, err := DetectSpeedtestCli(context.Background(), path)
+		if tt.version != "" && (info == nil || info.Version != tt.version || info.Official != tt.official || info.Path != path) {
+			t.Errorf("%s: info = %+v, want version %s official %v", tt.name, info, tt.version, tt.official)
+		}
+		var unavailable *SpeedtestCliUnavailableError
+		switch {
+		case tt.reason == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.reason != "" && (!errors.As(err, &unavailable) || unavailable.Reason != tt.reason):
+			t.Errorf("%s: err = %v, want the reason %q", tt.name, err, tt.reason)
+		}
+	}
+
+	_, err := DetectSpeedtestCli(context.Background(), filepath.Join(dir, "missing"))
+	var unavailable *SpeedtestCliUnavailableError
+	if !errors.As(err, &unavailable) || unavailable.Reason != "not found" {
+		t.Errorf("missing binary: err = %v, want not found", err)
+	}
+}
@@ -0,0 +1,34 @@
+package speedtest
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestBatchReportAdd(t *testing.T) {
+	full, cut := &SpeedReport{}, &SpeedReport{}
+	tests := []struct {
+		name    string
+		report  *SpeedReport
+		err     error
+		success []*SpeedReport
+		failed  []string
+		partial []*SpeedReport
+	}{
+		{"complete", full, nil, []*SpeedReport{full}, nil, nil},
+		{"cut short", cut, errors.New("context canceled"), nil, []string{"eth1"}, []*SpeedReport{cut}},
+		{"nothing measured", nil, errors.New("no server"), nil, []string{"eth1"}, nil},
+		{"no report, no error", nil, nil, nil, nil, nil},
+	}
+	for _, tt := range tests {
+		var b BatchReport
+		b.add("eth1", tt.report, tt.err)
+		if !reflect.DeepEqual(b.SuccessNet, tt.success) || !reflect.DeepEqual(b.FailedNet, tt.failed) || !reflect.DeepEqual(b.PartialNet, tt.partial) {
+			t.Errorf("%s: got %+v", tt.name, b)
+		}
+	}
+	if cut.Error != "context canceled" || full.Error != "" {
+		t.Errorf("errors = %q and %q, want only the cut short report's", full.Error, cut.Error)
+	}
+}
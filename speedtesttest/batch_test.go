@@ -0,0 +1,68 @@
+package speedtesttest
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Cocoon-break/speedtest"
+)
+
+// a run cancelled while downloading is kept in PartialNet and the batch returns ctx.Err()
+func TestBatchCancel(t *testing.T) {
+	batches := []struct {
+		name string
+		run  func(ctx context.Context, opts *speedtest.Options) (*speedtest.BatchReport, error)
+	}{
+		{"ConcurrentWithOptions", func(ctx context.Context, opts *speedtest.Options) (*speedtest.BatchReport, error) {
+			return speedtest.ConcurrentWithOptions(ctx, []string{""}, 10, false, opts)
+		}},
+		{"OnebyOneWithOptions", func(ctx context.Context, opts *speedtest.Options) (*speedtest.BatchReport, error) {
+			return speedtest.OnebyOneWithOptions(ctx, []string{""}, 10, false, 1, opts)
+		}},
+		{"ByMarks", func(ctx context.Context, opts *speedtest.Options) (*speedtest.BatchReport, error) {
+			// mark 0 sets no SO_MARK, no privileges needed
+			return speedtest.ByMarks(ctx, "", 10, false, []uint32{0}, opts)
+		}},
+	}
+	for _, batch := range batches {
+		s := NewServer()
+		s.SetBandwidth(256 << 10)
+		ctx, cancel := context.WithCancel(context.Background())
+		var once sync.Once
+		opts := s.Options()
+		// the upload runs first and takes the whole second, the download is cut short
+		opts.Duration = time.Second
+		opts.Pings = 1
+		opts.ProgressInterval = 10 * time.Millisecond
+		opts.Progress = func(p speedtest.Progress) {
+			if p.Phase == speedtest.PhaseDownload && p.Bytes > 0 {
+				once.Do(cancel)
+			}
+		}
+		report, err := batch.run(ctx, opts)
+		cancel()
+		s.Close()
+		if err != context.Canceled {
+			t.Errorf("%s: err = %v, want context.Canceled", batch.name, err)
+		}
+		if report == nil {
+			t.Errorf("%s: no batch report", batch.name)
+			continue
+		}
+		if len(report.SuccessNet) != 0 || len(report.FailedNet) != 1 || len(report.PartialNet) != 1 {
+			t.Errorf("%s: %d success, failed %v, %d partial, want the run failed and partial",
+				batch.name, len(report.SuccessNet), report.FailedNet, len(report.PartialNet))
+			continue
+		}
+		partial := report.PartialNet[0]
+		if partial.Error != context.Canceled.Error() {
+			t.Errorf("%s: partial error = %q, want %q", batch.name, partial.Error, context.Canceled)
+		}
+		if partial.Latency <= 0 || partial.UploadBytes <= 0 || partial.DownloadBytes <= 0 {
+			t.Errorf("%s: partial report = latency %v, %d up %d down bytes, want what was measured before the cancel",
+				batch.name, partial.Latency, partial.UploadBytes, partial.DownloadBytes)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+// Package speedtesttest provides an in-process speedtest backend for tests of
+// code built on the speedtest package, in the spirit of net/http/httptest
+package speedtesttest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Cocoon-break/speedtest"
+)
+
+// Endpoint names one of the emulated speedtest endpoints
+type Endpoint string
+
+const (
+	Config   Endpoint = "config"
+	Servers  Endpoint = "servers"
+	Latency  Endpoint = "latency"
+	Download Endpoint = "download"
+	Upload   Endpoint = "upload"
+)
+
+// Server is a fake speedtest.net backend listening on a local address.
+// Latency, bandwidth and failures can be changed while it is running
+type Server struct {
+	URL string
+	// Handler serves the speedtest protocol, its fields may be set before the first request
+	Handler *speedtest.Handler
+
+	ts *httptest.Server
+	// closed by Close so that throttled handlers don't keep it waiting
+	done chan struct{}
+
+	mu       sync.Mutex
+	latency  time.Duration
+	down, up *throttle
+	failures map[Endpoint]int
+	requests map[Endpoint]int
+}
+
+// NewServer starts and returns a new Server, the caller should call Close when finished
+func NewServer() *Server {
+	s := &Server{
+		Handler:  &speedtest.Handler{ID: "1", Name: "speedtesttest", Country: "Localhost", Sponsor: "speedtesttest"},
+		failures: make(map[Endpoint]int),
+		requests: make(map[Endpoint]int),
+		done:     make(chan struct{}),
+	}
+	s.ts = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = s.ts.URL
+	return s
+}
+
+// Close shuts down the server
+func (s *Server) Close() {
+	close(s.done)
+	s.ts.Close()
+}
+
+// SetLatency delays every response by d
+func (s *Server) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	s.latency = d
+	s.mu.Unlock()
+}
+
+// SetBandwidth limits all download responses together, and all upload bodies
+// together, to bytesPerSecond each, 0 removes the limit
+func (s *Server) SetBandwidth(bytesPerSecond int64) {
+	s.mu.Lock()
+	s.down, s.up = nil, nil
+	if bytesPerSecond > 0 {
+		s.down, s.up = newThrottle(bytesPerSecond, s.done), newThrottle(bytesPerSecond, s.done)
+	}
+	s.mu.Unlock()
+}
+
+// Fail makes every request to e answer with status, 0 restores the normal behavior
+func (s *Server) Fail(e Endpoint, status int) {
+	s.mu.Lock()
+	if status == 0 {
+		delete(s.failures, e)
+	} else {
+		s.failures[e] = status
+	}
+	s.mu.Unlock()
+}
+
+// Requests returns how many requests reached e
+func (s *Server) Requests(e Endpoint) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[e]
+}
+
+// Options returns speedtest options pointing the config and server list at s
+func (s *Server) Options() *speedtest.Options {
+	return &speedtest.Options{
+		ConfigURL:  s.URL + "/speedtest-config.php",
+		ServersURL: s.URL + "/speedtest-servers-static.php",
+	}
+}
+
+// Client returns a speedtest client wired to s
+func (s *Server) Client(ctx context.Context) (*speedtest.STClient, error) {
+	return speedtest.NewSTClient(ctx, "", 15, s.Options())
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	e := endpointOf(r.URL.Path)
+	s.mu.Lock()
+	s.requests[e]++
+	latency, down, up, status := s.latency, s.down, s.up, s.failures[e]
+	s.mu.Unlock()
+
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	if e == Download && down != nil {
+		w = &throttledWriter{ResponseWriter: w, t: down}
+	}
+	if e == Upload && up != nil {
+		r.Body = &throttledBody{ReadCloser: r.Body, t: up}
+	}
+	s.Handler.ServeHTTP(w, r)
+}
+
+func endpointOf(p string) Endpoint {
+	name := path.Base(p)
+	switch {
+	case name == "speedtest-config.php":
+		return Config
+	case name == "speedtest-servers-static.php":
+		return Servers
+	case name == "latency.txt":
+		return Latency
+	case name == "upload.php":
+		return Upload
+	case strings.HasPrefix(name, "random"):
+		return Download
+	}
+	return Endpoint(name)
+}
+
+// throttle paces every stream sharing it so that together they do not run
+// faster than rate bytes per second
+type throttle struct {
+	rate int64
+	done <-chan struct{}
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+func newThrottle(rate int64, done <-chan struct{}) *throttle {
+	return &throttle{rate: rate, done: done}
+}
+
+var errClosed = errors.New("speedtesttest: server closed")
+
+// chunk is the most that may be moved before the next wait
+func (t *throttle) chunk() int {
+	c := t.rate / 20
+	if c < 512 {
+		c = 512
+	}
+	return int(c)
+}
+
+// wait fails once the server is closed, the data the client left in the
+// socket buffers would otherwise keep a handler busy long after it went away
+func (t *throttle) wait(n int) error {
+	t.mu.Lock()
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	t.next = t.next.Add(time.Duration(float64(n) / float64(t.rate) * float64(time.Second)))
+	due := t.next
+	t.mu.Unlock()
+	if d := time.Until(due); d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-t.done:
+			return errClosed
+		}
+	}
+	return nil
+}
+
+type throttledWriter struct {
+	http.ResponseWriter
+	t *throttle
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if c := w.t.chunk(); n > c {
+			n = c
+		}
+		n, err := w.ResponseWriter.Write(p[:n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if err := w.t.wait(n); err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+type throttledBody struct {
+	io.ReadCloser
+	t *throttle
+}
+
+func (b *throttledBody) Read(p []byte) (int, error) {
+	if c := b.t.chunk(); len(p) > c {
+		p = p[:c]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if waitErr := b.t.wait(n); waitErr != nil {
+		return n, waitErr
+	}
+	return n, err
+}
@@ -0,0 +1,153 @@
+package speedtesttest
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Cocoon-break/speedtest"
+)
+
+func TestServerReport(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	opts := s.Options()
+	opts.Duration = 300 * time.Millisecond
+	opts.Pings = 3
+	report, err := speedtest.ByDistanceWithOptions(context.Background(), "", 10, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.SpeedtestServer.ID != "1" || report.SpeedtestServer.Name != "speedtesttest" {
+		t.Errorf("server = %+v, want the speedtesttest one", report.SpeedtestServer)
+	}
+	if report.DownloadBytes <= 0 || report.DownloadSpeed <= 0 {
+		t.Errorf("download = %d bytes %.2f Mbit/s, want both positive", report.DownloadBytes, report.DownloadSpeed)
+	}
+	if report.UploadBytes <= 0 || report.UploadSpeed <= 0 {
+		t.Errorf("upload = %d bytes %.2f Mbit/s, want both positive", report.UploadBytes, report.UploadSpeed)
+	}
+	if report.LatencyStats == nil || report.LatencyStats.Probes != 3 {
+		t.Errorf("latency stats = %+v, want 3 probes", report.LatencyStats)
+	}
+	for _, e := range []Endpoint{Config, Servers, Latency, Download, Upload} {
+		if s.Requests(e) == 0 {
+			t.Errorf("no request reached %s", e)
+		}
+	}
+}
+
+// the fixed workload is sampled while it runs, go test -race checks the counters.
+// It moves the most data of these tests, the race detector makes it take a while
+func TestServerProgress(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	opts := s.Options()
+	opts.ProgressInterval = 10 * time.Millisecond
+	var samples int32
+	opts.Progress = func(p speedtest.Progress) {
+		if p.Phase == speedtest.PhaseDownload || p.Phase == speedtest.PhaseUpload {
+			atomic.AddInt32(&samples, 1)
+		}
+	}
+	report, err := speedtest.ByDistanceWithOptions(context.Background(), "", 60, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.DownloadBytes <= 0 || report.UploadBytes <= 0 {
+		t.Errorf("report = %d down %d up bytes, want both positive", report.DownloadBytes, report.UploadBytes)
+	}
+	if atomic.LoadInt32(&samples) < 4 {
+		t.Errorf("%d transfer progress events, want samples of both directions", samples)
+	}
+}
+
+func TestServerFail(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.Fail(Config, http.StatusServiceUnavailable)
+	if _, err := s.Client(context.Background()); err == nil {
+		t.Fatal("client created while the config endpoint fails")
+	}
+	s.Fail(Config, 0)
+	st, err := s.Client(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers, err := st.FetchServerListContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 1 || servers[0].ID != "1" {
+		t.Errorf("servers = %d, want the one of the handler", len(servers))
+	}
+	if got := s.Requests(Config); got != 2 {
+		t.Errorf("config requests = %d, want 2", got)
+	}
+}
+
+func TestServerLatency(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.SetLatency(40 * time.Millisecond)
+	st, err := s.Client(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers, err := st.FetchServerListContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers, err = st.ServerListByLatencyContext(context.Background(), servers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the latency is half of the round trip
+	if got := servers[0].Latency; got < 20*time.Millisecond {
+		t.Errorf("latency = %v, want at least 20ms", got)
+	}
+}
+
+func TestServerBandwidth(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.SetBandwidth(1 << 20)
+	opts := s.Options()
+	opts.Duration = 500 * time.Millisecond
+	opts.Pings = 1
+	report, err := speedtest.ByDistanceWithOptions(context.Background(), "", 10, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 1 MiB/s is 8.4 Mbit/s, leave room for the first burst. The upload is
+	// counted as it is written, the socket buffers make it look faster
+	if speed := report.DownloadSpeed; speed <= 0 || speed > 16 {
+		t.Errorf("download = %.2f Mbit/s, want about 8.4", speed)
+	}
+	if report.UploadBytes <= 0 {
+		t.Error("nothing uploaded")
+	}
+}
+
+func TestServerCancel(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.SetBandwidth(256 << 10)
+	opts := s.Options()
+	opts.Duration = 10 * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	report, err := speedtest.ByDistanceWithOptions(ctx, "", 10, opts)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("err = %v, want context.DeadlineExceeded", err)
+	}
+	if report == nil {
+		t.Fatal("no partial report")
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("cancelled test took %v", elapsed)
+	}
+}
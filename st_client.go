@@ -1,11 +1,13 @@
 package speedtest
 
 import (
+	"context"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"net/http"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 )
@@ -16,7 +18,8 @@ const stConfigUrl = "https://www.speedtest.net/speedtest-config.php"
 // 从speedtest获取可以测速的站点列表
 const stServersUrl = "https://www.speedtest.net/speedtest-servers-static.php"
 
-type config struct {
+// Config is the client information reported by speedtest-config.php
+type Config struct {
 	IP  string
 	Lat float64
 	Lon float64
@@ -28,9 +31,13 @@ type netInterface struct {
 }
 
 type STClient struct {
-	Config       *config
+	Config       *Config
 	NetInterface *netInterface
 	Timeout      int
+
+	interfaceOp string
+	opts        *Options
+	httpUtil    *httpUtil
 }
 
 // speedtest response xml
@@ -43,22 +50,46 @@ type remoteConfig struct {
 	} `xml:"client"`
 }
 
-func initStClient(interfaceOp string, timeout int) (*STClient, error) {
-	url := fmt.Sprintf("%s?x=%+v", stConfigUrl, time.Now().Unix())
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+// NewSTClient fetches the client config through interfaceOp, opts may be nil
+func NewSTClient(ctx context.Context, interfaceOp string, timeout int, opts *Options) (*STClient, error) {
+	return initStClient(ctx, interfaceOp, timeout, opts)
+}
+
+func initStClient(ctx context.Context, interfaceOp string, timeout int, opts *Options) (*STClient, error) {
+	opts.progress(Progress{Phase: PhaseConfig, NetInterface: interfaceOp})
+	httpUtil, err := getHttpUtil(interfaceOp, timeout, opts)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Cache-Control", "no-cache")
-	httpUtil, err := getHttpUtil(interfaceOp, timeout)
+	n := &netInterface{
+		Name:       httpUtil.Interface.Name,
+		InternalIp: httpUtil.Interface.InternalIp,
+	}
+	if opts != nil && opts.Config != nil {
+		c := *opts.Config
+		return &STClient{
+			Config:       &c,
+			NetInterface: n,
+			Timeout:      timeout,
+			interfaceOp:  interfaceOp,
+			opts:         opts,
+			httpUtil:     httpUtil,
+		}, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, noCacheURL(opts.configURL()), nil)
 	if err != nil {
 		return nil, err
 	}
+	req.Header.Set("Cache-Control", "no-cache")
 	resp, err := httpUtil.Client.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
+	if err := checkStatus(resp); err != nil {
+		return nil, err
+	}
 
 	decoder := xml.NewDecoder(resp.Body)
 	var remoteConfig remoteConfig
@@ -70,25 +101,24 @@ func initStClient(interfaceOp string, timeout int) (*STClient, error) {
 		return nil, errors.New("failed to fetch speedtest config clients information")
 	}
 	client := remoteConfig.Clients[0]
-	c := &config{
+	c := &Config{
 		IP:  client.IP,
 		Lat: stringToFloat(client.Lat),
 		Lon: stringToFloat(client.Lon),
 		Isp: client.Isp,
 	}
-	n := &netInterface{
-		Name:       httpUtil.Interface.Name,
-		InternalIp: httpUtil.Interface.InternalIp,
-	}
 	return &STClient{
 		Config:       c,
 		NetInterface: n,
 		Timeout:      timeout,
+		interfaceOp:  interfaceOp,
+		opts:         opts,
+		httpUtil:     httpUtil,
 	}, nil
 }
 
-// speedtest response xml
-type server struct {
+// Server is a test server as listed by speedtest-servers-static.php
+type Server struct {
 	URL     string `xml:"url,attr" json:"url"`
 	Lat     string `xml:"lat,attr" json:"lat"`
 	Lon     string `xml:"lon,attr" json:"lon"`
@@ -102,24 +132,32 @@ type server struct {
 
 // speedtest response xml
 type serverList struct {
-	Servers []server `xml:"servers>server"`
+	Servers []Server `xml:"servers>server"`
 }
 
 func (st *STClient) ServerListByLatency(servers []*serverItem) ([]*serverItem, error) {
+	return st.ServerListByLatencyContext(context.Background(), servers)
+}
+
+// ServerListByLatencyContext is like ServerListByLatency but aborts the probes when ctx is done
+func (st *STClient) ServerListByLatencyContext(ctx context.Context, servers []*serverItem) ([]*serverItem, error) {
 	wg := sync.WaitGroup{}
 	for i := range servers {
 		wg.Add(1)
 		go func(s *serverItem, in string) {
-			latency, err := s.LatencyTest(in, 15)
+			latency, err := s.LatencyTestContext(ctx, in, 15)
 			if err != nil {
 				s.Latency = time.Duration(1 * time.Minute)
 			} else {
 				s.Latency = latency
 			}
 			wg.Done()
-		}(servers[i], st.NetInterface.Name)
+		}(servers[i], st.interfaceOp)
 	}
 	wg.Wait()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
 	sort.Sort(latency(servers))
 	return servers, nil
 }
@@ -135,33 +173,49 @@ func (st *STClient) ServerListByDistance(servers []*serverItem) ([]*serverItem,
 
 // fetch server list from speedtest api
 func (st *STClient) FetchServerList() ([]*serverItem, error) {
+	return st.FetchServerListContext(context.Background())
+}
+
+// FetchServerListContext is like FetchServerList but the request is bound to ctx
+func (st *STClient) FetchServerListContext(ctx context.Context) ([]*serverItem, error) {
 	if st.Config == nil {
 		return nil, errors.New("didn't init config")
 	}
-	url := fmt.Sprintf("%s?x=%+v", stServersUrl, time.Now().Unix())
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+	st.opts.progress(Progress{Phase: PhaseServerSelection, NetInterface: st.interfaceOp})
+	if st.opts != nil && st.opts.Servers != nil {
+		return toServerItems(st.opts.Servers, st.opts), nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, noCacheURL(st.opts.serversURL()), nil)
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Cache-Control", "no-cache")
-	httpUtil, err := getHttpUtil(st.NetInterface.Name, st.Timeout)
-	if err != nil {
-		return nil, err
+	if st.httpUtil == nil {
+		if st.httpUtil, err = getHttpUtil(st.interfaceOp, st.Timeout, st.opts); err != nil {
+			return nil, err
+		}
 	}
-	resp, err := httpUtil.Client.Do(req)
+	resp, err := st.httpUtil.Client.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
+	if err := checkStatus(resp); err != nil {
+		return nil, err
+	}
 	decoder := xml.NewDecoder(resp.Body)
 
 	var list serverList
 	if err := decoder.Decode(&list); err != nil {
 		return nil, err
 	}
-	serverItems := make([]*serverItem, 0, len(list.Servers))
-	for i := range list.Servers {
-		speedtestServer := list.Servers[i]
+	return toServerItems(list.Servers, st.opts), nil
+}
+
+func toServerItems(servers []Server, opts *Options) []*serverItem {
+	serverItems := make([]*serverItem, 0, len(servers))
+	for i := range servers {
+		speedtestServer := servers[i]
 		sItem := &serverItem{}
 		sItem.URL = speedtestServer.URL
 		sItem.Lat = stringToFloat(speedtestServer.Lat)
@@ -170,7 +224,18 @@ func (st *STClient) FetchServerList() ([]*serverItem, error) {
 		sItem.Country = speedtestServer.Country
 		sItem.Sponsor = speedtestServer.Sponsor
 		sItem.ID = speedtestServer.ID
+		sItem.Host = speedtestServer.Host
+		sItem.opts = opts
 		serverItems = append(serverItems, sItem)
 	}
-	return serverItems, nil
+	return serverItems
+}
+
+// append a timestamp so that caches between us and the server are bypassed
+func noCacheURL(u string) string {
+	sep := "?"
+	if strings.Contains(u, "?") {
+		sep = "&"
+	}
+	return fmt.Sprintf("%s%sx=%+v", u, sep, time.Now().Unix())
 }
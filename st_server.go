@@ -0,0 +1,157 @@
+package speedtest
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// biggest random{N}x{N}.jpg served, matches the largest entry of dlSizes
+const maxRandomSize = 4000
+
+// Handler serves the legacy Ookla HTTP protocol: speedtest-config.php,
+// speedtest-servers-static.php, latency.txt, random{N}x{N}.jpg and upload.php.
+// The test endpoints are matched on the last path element, so the handler can
+// be mounted under any prefix
+type Handler struct {
+	ID      string
+	Name    string
+	Country string
+	Sponsor string
+	Lat     float64
+	Lon     float64
+	// Host is the host:port of a TCPServer announced in the server list, by default
+	// the address the request was sent to. A bare ":port" takes the host of the request
+	Host string
+	// Servers replaces the list served by speedtest-servers-static.php,
+	// by default only this handler is listed
+	Servers []Server
+}
+
+// speedtest-config.php response xml
+type configResponse struct {
+	XMLName xml.Name `xml:"settings"`
+	Client  struct {
+		IP  string `xml:"ip,attr"`
+		Lat string `xml:"lat,attr"`
+		Lon string `xml:"lon,attr"`
+		Isp string `xml:"isp,attr"`
+	} `xml:"client"`
+}
+
+// speedtest-servers-static.php response xml
+type serversResponse struct {
+	XMLName xml.Name `xml:"settings"`
+	Servers []Server `xml:"servers>server"`
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-cache")
+	name := path.Base(r.URL.Path)
+	switch {
+	case name == "speedtest-config.php":
+		h.serveConfig(w, r)
+	case name == "speedtest-servers-static.php":
+		h.serveServers(w, r)
+	case name == "latency.txt":
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "test=test\n")
+	case name == "upload.php":
+		h.serveUpload(w, r)
+	case strings.HasPrefix(name, "random") && strings.HasSuffix(name, ".jpg"):
+		h.serveRandom(w, r, strings.TrimSuffix(strings.TrimPrefix(name, "random"), ".jpg"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *Handler) serveConfig(w http.ResponseWriter, r *http.Request) {
+	var resp configResponse
+	resp.Client.IP = r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		resp.Client.IP = host
+	}
+	resp.Client.Lat = strconv.FormatFloat(h.Lat, 'f', -1, 64)
+	resp.Client.Lon = strconv.FormatFloat(h.Lon, 'f', -1, 64)
+	resp.Client.Isp = h.Sponsor
+	writeXML(w, resp)
+}
+
+func (h *Handler) serveServers(w http.ResponseWriter, r *http.Request) {
+	resp := serversResponse{Servers: h.Servers}
+	if len(resp.Servers) == 0 {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		base := scheme + "://" + r.Host + path.Dir(r.URL.Path)
+		host := h.Host
+		if host == "" {
+			host = r.Host
+		} else if strings.HasPrefix(host, ":") {
+			hostname := r.Host
+			if name, _, err := net.SplitHostPort(r.Host); err == nil {
+				hostname = name
+			}
+			host = net.JoinHostPort(strings.Trim(hostname, "[]"), host[1:])
+		}
+		resp.Servers = []Server{{
+			URL:     strings.TrimSuffix(base, "/") + "/upload.php",
+			Lat:     strconv.FormatFloat(h.Lat, 'f', -1, 64),
+			Lon:     strconv.FormatFloat(h.Lon, 'f', -1, 64),
+			Name:    h.Name,
+			Country: h.Country,
+			Sponsor: h.Sponsor,
+			ID:      h.ID,
+			Host:    host,
+		}}
+	}
+	writeXML(w, resp)
+}
+
+func (h *Handler) serveUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	n, err := io.Copy(ioutil.Discard, r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintf(w, "size=%d", n)
+}
+
+// random{N}x{N}.jpg is N*N*2 bytes, the size downloadTest expects
+func (h *Handler) serveRandom(w http.ResponseWriter, r *http.Request, dimension string) {
+	sizes := strings.SplitN(dimension, "x", 2)
+	if len(sizes) != 2 || sizes[0] != sizes[1] {
+		http.NotFound(w, r)
+		return
+	}
+	size, err := strconv.Atoi(sizes[0])
+	if err != nil || size <= 0 || size > maxRandomSize {
+		http.NotFound(w, r)
+		return
+	}
+	length := int64(size) * int64(size) * 2
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	if r.Method == http.MethodHead {
+		return
+	}
+	io.Copy(w, newRandomPayload(length))
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(v)
+}
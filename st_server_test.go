@@ -0,0 +1,102 @@
+package speedtest
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandlerServers(t *testing.T) {
+	ts := httptest.NewServer(&Handler{ID: "7", Name: "lab", Sponsor: "Acme", Lat: 1.5, Lon: -2, Host: ":8081"})
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + "/speedtest/speedtest-servers-static.php")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var list serverList
+	if err := xml.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Servers) != 1 {
+		t.Fatalf("%d servers, want 1", len(list.Servers))
+	}
+	s := list.Servers[0]
+	if s.ID != "7" || s.Name != "lab" || s.Sponsor != "Acme" || s.Lat != "1.5" || s.Lon != "-2" {
+		t.Errorf("server = %+v", s)
+	}
+	// the handler is mounted under /speedtest, the test endpoints follow it
+	if want := ts.URL + "/speedtest/upload.php"; s.URL != want {
+		t.Errorf("url = %s, want %s", s.URL, want)
+	}
+	if s.Host != "127.0.0.1:8081" {
+		t.Errorf("host = %s, want the request host with the :8081 port", s.Host)
+	}
+}
+
+func TestHandlerConfig(t *testing.T) {
+	ts := httptest.NewServer(&Handler{Sponsor: "Acme", Lat: 3, Lon: 4})
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + "/speedtest-config.php")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var config configResponse
+	if err := xml.NewDecoder(resp.Body).Decode(&config); err != nil {
+		t.Fatal(err)
+	}
+	if c := config.Client; c.IP != "127.0.0.1" || c.Isp != "Acme" || c.Lat != "3" || c.Lon != "4" {
+		t.Errorf("client = %+v", c)
+	}
+}
+
+func TestHandlerTransfers(t *testing.T) {
+	ts := httptest.NewServer(&Handler{})
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/random350x350.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(body) != 350*350*2 || resp.ContentLength != int64(len(body)) {
+		t.Errorf("random350x350.jpg = %d bytes, Content-Length %d, want %d", len(body), resp.ContentLength, 350*350*2)
+	}
+
+	resp, err = http.Post(ts.URL+"/upload.php", "application/octet-stream", strings.NewReader(strings.Repeat("x", 12345)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "size=12345" {
+		t.Errorf("upload.php = %q, want size=12345", body)
+	}
+
+	for _, path := range []string{"/random350x500.jpg", "/random0x0.jpg", "/nothing"} {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s = %s, want 404", path, resp.Status)
+		}
+	}
+	resp, err = http.Get(ts.URL + "/upload.php")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET upload.php = %s, want 405", resp.Status)
+	}
+}
@@ -0,0 +1,138 @@
+package speedtest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a connection waiting this long for a command, or for a transfer to progress, is dropped
+const tcpServerIdleTimeout = time.Minute
+
+// biggest DOWNLOAD or UPLOAD accepted by TCPServer
+const maxTCPServerChunk = 1 << 30
+
+// TCPServer serves the Ookla TCP protocol the TransportTCP client speaks:
+// HI, GETIP, PING, DOWNLOAD, UPLOAD and QUIT, one command per line
+type TCPServer struct{}
+
+// ListenAndServe listens on the TCP address addr and serves the connections
+func (s *TCPServer) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	return s.Serve(l)
+}
+
+// Serve accepts the connections of l until it fails
+func (s *TCPServer) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn answers the commands of conn until QUIT, an error or an unknown command, then closes it
+func (s *TCPServer) ServeConn(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	for {
+		conn.SetDeadline(time.Now().Add(tcpServerIdleTimeout))
+		line, err := br.ReadString('\n')
+		if err != nil || len(line) > maxTCPLine {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "HI":
+			err = writeLine(conn, "HELLO 2.9 (2.9.0) speedtest")
+		case "GETIP":
+			ip := conn.RemoteAddr().String()
+			if host, _, splitErr := net.SplitHostPort(ip); splitErr == nil {
+				ip = host
+			}
+			err = writeLine(conn, "YOURIP "+ip)
+		case "PING":
+			err = writeLine(conn, "PONG "+strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10))
+		case "DOWNLOAD":
+			err = s.download(conn, fields)
+		case "UPLOAD":
+			err = s.upload(conn, br, fields, int64(len(line)))
+		case "QUIT":
+			return
+		default:
+			writeLine(conn, "ERROR unknown command")
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// DOWNLOAD size answers size bytes: "DOWNLOAD ", random bytes and a newline
+func (s *TCPServer) download(conn net.Conn, fields []string) error {
+	size, err := tcpChunkSize(fields)
+	if err != nil {
+		writeLine(conn, "ERROR "+err.Error())
+		return err
+	}
+	prefix := "DOWNLOAD "
+	if size < int64(len(prefix))+1 {
+		return writeLine(conn, prefix[:size-1])
+	}
+	if _, err := io.WriteString(conn, prefix); err != nil {
+		return err
+	}
+	if _, err := io.Copy(conn, newRandomPayload(size-int64(len(prefix))-1)); err != nil {
+		return err
+	}
+	_, err = io.WriteString(conn, "\n")
+	return err
+}
+
+// UPLOAD size 0 is followed by size bytes counted from the start of the command line,
+// answered with "OK size milliseconds"
+func (s *TCPServer) upload(conn net.Conn, br *bufio.Reader, fields []string, lineSize int64) error {
+	size, err := tcpChunkSize(fields)
+	if err != nil {
+		writeLine(conn, "ERROR "+err.Error())
+		return err
+	}
+	sTime := time.Now()
+	if rest := size - lineSize; rest > 0 {
+		if _, err := io.CopyN(ioutil.Discard, br, rest); err != nil {
+			return err
+		}
+	}
+	return writeLine(conn, fmt.Sprintf("OK %d %d", size, time.Since(sTime)/time.Millisecond))
+}
+
+func tcpChunkSize(fields []string) (int64, error) {
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("%s needs a size", fields[0])
+	}
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || size <= 0 || size > maxTCPServerChunk {
+		return 0, fmt.Errorf("bad size %s", fields[1])
+	}
+	return size, nil
+}
+
+func writeLine(w io.Writer, line string) error {
+	_, err := io.WriteString(w, line+"\n")
+	return err
+}
@@ -0,0 +1,119 @@
+package speedtest
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func tcpTestServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go (&TCPServer{}).Serve(l)
+	return l.Addr().String()
+}
+
+func TestTCPServerCommands(t *testing.T) {
+	conn, err := net.Dial("tcp", tcpTestServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(conn)
+	command := func(line string) string {
+		if _, err := io.WriteString(conn, line+"\n"); err != nil {
+			t.Fatal(err)
+		}
+		reply, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+		return strings.TrimSpace(reply)
+	}
+
+	if reply := command("HI"); !strings.HasPrefix(reply, "HELLO ") {
+		t.Errorf("HI = %q, want HELLO", reply)
+	}
+	if reply := command("GETIP"); reply != "YOURIP 127.0.0.1" {
+		t.Errorf("GETIP = %q, want YOURIP 127.0.0.1", reply)
+	}
+	if reply := command("PING 1"); !strings.HasPrefix(reply, "PONG ") {
+		t.Errorf("PING = %q, want PONG", reply)
+	}
+
+	// the size counts the DOWNLOAD prefix and the newline
+	fmt.Fprintf(conn, "DOWNLOAD %d\n", 1000)
+	reply := make([]byte, 1000)
+	if _, err := io.ReadFull(br, reply); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(reply), "DOWNLOAD ") || reply[999] != '\n' {
+		t.Errorf("DOWNLOAD 1000 = %q...%q", reply[:9], reply[999:])
+	}
+
+	// so does the size of an upload, the command line included
+	header := "UPLOAD 1000 0\n"
+	io.WriteString(conn, header+strings.Repeat("x", 1000-len(header)))
+	if reply, _ := br.ReadString('\n'); !strings.HasPrefix(reply, "OK 1000 ") {
+		t.Errorf("UPLOAD 1000 = %q, want OK 1000", reply)
+	}
+
+	if reply := command("DOWNLOAD x"); !strings.HasPrefix(reply, "ERROR ") {
+		t.Errorf("DOWNLOAD x = %q, want an ERROR", reply)
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Errorf("connection open after an error: %v", err)
+	}
+}
+
+func TestTCPServerQuit(t *testing.T) {
+	conn, err := net.Dial("tcp", tcpTestServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "QUIT\n")
+	if rest, err := ioutil.ReadAll(conn); err != nil || len(rest) != 0 {
+		t.Errorf("after QUIT read %q, %v, want the connection closed", rest, err)
+	}
+}
+
+// the native backend finds the TCPServer through the host the Handler announces
+func TestTCPServerBackend(t *testing.T) {
+	ts := httptest.NewServer(&Handler{ID: "5", Name: "lab", Host: tcpTestServer(t)})
+	defer ts.Close()
+	report, err := runTest(context.Background(), BackendConfig{
+		Timeout: 10,
+		Options: &Options{
+			ConfigURL:  ts.URL + "/speedtest-config.php",
+			ServersURL: ts.URL + "/speedtest/speedtest-servers-static.php",
+			Transport:  TransportTCP,
+			Duration:   300 * time.Millisecond,
+			Pings:      3,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.SpeedtestServer.ID != "5" {
+		t.Errorf("server = %+v, want the handler's", report.SpeedtestServer)
+	}
+	if report.LatencyStats == nil || report.LatencyStats.Probes != 3 {
+		t.Errorf("latency stats = %+v, want 3 PINGs", report.LatencyStats)
+	}
+	if report.DownloadBytes <= 0 || report.UploadBytes <= 0 {
+		t.Errorf("transferred %d down %d up bytes, want both positive", report.DownloadBytes, report.UploadBytes)
+	}
+}
@@ -0,0 +1,172 @@
+package speedtest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// each direction of ByURL runs this long when Options.Duration is not set
+	defaultURLDuration = 10 * time.Second
+	// size of the ranges asked by ranged downloads and of the bodies posted to the upload URL
+	urlChunkSize = 16 * 1000 * 1000
+)
+
+// URLReport is the SpeedReport of ByURL with what only a plain URL test measures
+type URLReport struct {
+	SpeedReport
+	// TTFB is the mean time from sending a download request to its response headers
+	TTFB time.Duration `json:"ttfb"`
+	// Ranged is true when the object was fetched in byte ranges instead of repeated full GETs
+	Ranged   bool `json:"ranged"`
+	Requests int  `json:"requests"`
+}
+
+// ByURL measures the throughput to any HTTP object through interfaceOp: downloadURL
+// is fetched on Options.Streams parallel connections for Options.Duration (10s by
+// default), in byte ranges when the server supports them and the object is big,
+// with repeated GETs otherwise. When uploadURL is not empty random data is then
+// posted to it the same way. When ctx is done the partial report is returned with ctx.Err()
+func ByURL(ctx context.Context, interfaceOp string, timeout int, downloadURL, uploadURL string, opts *Options) (*URLReport, error) {
+	target, err := url.Parse(downloadURL)
+	if err != nil {
+		return nil, err
+	}
+	session, err := getHttpUtil(interfaceOp, timeout, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Client.CloseIdleConnections()
+	client := session.Client
+
+	report := &URLReport{}
+	report.SpeedtestServer.ID = downloadURL
+	report.SpeedtestServer.Name = target.Host
+	report.SpeedtestServer.Host = target.Host
+	report.NetInterface.Name = interfaceOp
+	report.NetInterface.InternalIp = session.Interface.InternalIp
+	report.NetInterface.Family = ipFamily(session.Interface.InternalIp, opts.family())
+	opts.fillRouting(&report.SpeedReport)
+
+	size, err := rangeSize(ctx, client, downloadURL)
+	if err != nil {
+		return nil, err
+	}
+	report.Ranged = size > urlChunkSize
+	duration := opts.duration()
+	if duration <= 0 {
+		duration = defaultURLDuration
+	}
+
+	var next, requests, ttfb int64
+	p := Progress{Phase: PhaseDownload, NetInterface: interfaceOp, Server: target.Host}
+	report.DownloadSpeed, report.DownloadBytes, err = opts.runFor(ctx, p, duration, opts.streams(), func(runCtx context.Context, received *int64) error {
+		byteRange := ""
+		if report.Ranged {
+			// the streams walk through the object one range after the other
+			start := (atomic.AddInt64(&next, urlChunkSize) - urlChunkSize) % size
+			end := start + urlChunkSize - 1
+			if end >= size {
+				end = size - 1
+			}
+			byteRange = fmt.Sprintf("bytes=%d-%d", start, end)
+		}
+		firstByte, err := fetch(runCtx, client, downloadURL, byteRange, received)
+		if firstByte > 0 {
+			atomic.AddInt64(&requests, 1)
+			atomic.AddInt64(&ttfb, int64(firstByte))
+		}
+		return err
+	})
+	if n := atomic.LoadInt64(&requests); n > 0 {
+		report.Requests = int(n)
+		report.TTFB = time.Duration(atomic.LoadInt64(&ttfb) / n)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return report, ctx.Err()
+		}
+		return nil, err
+	}
+
+	if uploadURL != "" {
+		p := Progress{Phase: PhaseUpload, NetInterface: interfaceOp, Server: target.Host}
+		report.UploadSpeed, report.UploadBytes, err = opts.runFor(ctx, p, duration, opts.streams(), func(runCtx context.Context, sent *int64) error {
+			return upload(runCtx, client, uploadURL, binaryContentType, newRandomPayload(urlChunkSize), sent)
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return report, ctx.Err()
+			}
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// rangeSize asks for the first byte of rawURL and returns the size of the object
+// when the server answers with a range, 0 when it doesn't support ranges
+func rangeSize(ctx context.Context, client *http.Client, rawURL string) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	// a server ignoring the range sends the whole object, don't wait for it
+	defer resp.Body.Close()
+	if err := checkStatus(resp); err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		return 0, nil
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1024))
+	// Content-Range: bytes 0-0/size
+	contentRange := resp.Header.Get("Content-Range")
+	i := strings.LastIndex(contentRange, "/")
+	if i < 0 {
+		return 0, nil
+	}
+	size, err := strconv.ParseInt(contentRange[i+1:], 10, 64)
+	if err != nil {
+		// "*" when the size is unknown
+		return 0, nil
+	}
+	return size, nil
+}
+
+// fetch downloads rawURL, or byteRange of it, adding the body bytes to n. It
+// returns the time until the response headers arrived, 0 when they didn't
+func fetch(ctx context.Context, client *http.Client, rawURL, byteRange string, n *int64) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	if byteRange != "" {
+		req.Header.Set("Range", byteRange)
+	}
+	sTime := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	firstByte := time.Since(sTime)
+	defer resp.Body.Close()
+	if err := checkStatus(resp); err != nil {
+		return firstByte, err
+	}
+	_, err = io.Copy(ioutil.Discard, &countingReader{r: resp.Body, n: n})
+	return firstByte, err
+}
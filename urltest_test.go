@@ -0,0 +1,150 @@
+package speedtest
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const urlTestDuration = 300 * time.Millisecond
+
+// urlTestServer serves object at /object, with byte ranges when ranged, takes
+// uploads at /upload and counts what it wrote and read
+type urlTestServer struct {
+	*httptest.Server
+	written, read, requests int64
+}
+
+func newURLTestServer(t *testing.T, object []byte, ranged bool) *urlTestServer {
+	s := &urlTestServer{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/object", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&s.requests, 1)
+		counting := &urlCountingWriter{ResponseWriter: w, n: &s.written}
+		if ranged {
+			http.ServeContent(counting, r, "object", time.Time{}, bytes.NewReader(object))
+			return
+		}
+		counting.Write(object)
+	})
+	mux.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
+		// counted as it arrives, the client cancels the last bodies unfinished
+		io.Copy(ioutil.Discard, &countingReader{r: r.Body, n: &s.read})
+	})
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+type urlCountingWriter struct {
+	http.ResponseWriter
+	n *int64
+}
+
+func (w *urlCountingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	atomic.AddInt64(w.n, int64(n))
+	return n, err
+}
+
+// the speed of a direction is over its bytes and the test duration
+func checkURLSpeed(t *testing.T, direction string, speed float64, n int64) {
+	if speed <= 0 {
+		t.Errorf("%s speed = %.2f, want > 0", direction, speed)
+		return
+	}
+	elapsed := time.Duration(float64(n) * 8 / 1000 / 1000 / speed * float64(time.Second))
+	if elapsed < urlTestDuration*9/10 || elapsed > urlTestDuration+time.Second {
+		t.Errorf("%s %d bytes at %.2f Mbit/s is %v, want about %v", direction, n, speed, elapsed, urlTestDuration)
+	}
+}
+
+func TestByURL(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int
+		ranged bool
+		// whether ByURL fetches in byte ranges, only for objects bigger than a range
+		wantRanged bool
+	}{
+		{"ranged", 2*urlChunkSize + 1000, true, true},
+		{"small ranged", 1 << 20, true, false},
+		{"no ranges", 1 << 20, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newURLTestServer(t, make([]byte, tt.size), tt.ranged)
+			opts := &Options{Duration: urlTestDuration, Streams: 2}
+			report, err := ByURL(context.Background(), "", 10, s.URL+"/object", s.URL+"/upload", opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Ranged != tt.wantRanged {
+				t.Errorf("ranged = %v, want %v", report.Ranged, tt.wantRanged)
+			}
+			written, read := atomic.LoadInt64(&s.written), atomic.LoadInt64(&s.read)
+			// the client counts what it received, at most what the server wrote
+			if report.DownloadBytes <= 0 || report.DownloadBytes > written {
+				t.Errorf("download = %d bytes, server wrote %d", report.DownloadBytes, written)
+			}
+			// the server reads at most what the client sent
+			if read <= 0 || read > report.UploadBytes {
+				t.Errorf("upload = %d bytes, server read %d", report.UploadBytes, read)
+			}
+			checkURLSpeed(t, "download", report.DownloadSpeed, report.DownloadBytes)
+			checkURLSpeed(t, "upload", report.UploadSpeed, report.UploadBytes)
+			// the range probe is not one of the counted requests
+			if report.Requests <= 0 || int64(report.Requests) >= atomic.LoadInt64(&s.requests) || report.TTFB <= 0 {
+				t.Errorf("%d requests of %d served, ttfb %v", report.Requests, atomic.LoadInt64(&s.requests), report.TTFB)
+			}
+			if report.SpeedtestServer.ID != s.URL+"/object" || report.SpeedtestServer.Host != s.Listener.Addr().String() {
+				t.Errorf("server = %+v, want the download URL", report.SpeedtestServer)
+			}
+		})
+	}
+}
+
+func TestByURLDownloadOnly(t *testing.T) {
+	s := newURLTestServer(t, make([]byte, 1<<20), true)
+	report, err := ByURL(context.Background(), "", 10, s.URL+"/object", "", &Options{Duration: urlTestDuration})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.DownloadBytes <= 0 || report.UploadBytes != 0 || report.UploadSpeed != 0 || atomic.LoadInt64(&s.read) != 0 {
+		t.Errorf("download %d upload %d bytes, want only a download", report.DownloadBytes, report.UploadBytes)
+	}
+}
+
+func TestByURLStatus(t *testing.T) {
+	// the first request answers, every following one fails
+	var served int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		if atomic.AddInt64(&served, 1) > 1 {
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(make([]byte, 1000))
+	}))
+	defer ts.Close()
+	opts := &Options{Duration: urlTestDuration}
+
+	report, err := ByURL(context.Background(), "", 10, ts.URL+"/missing", "", opts)
+	if err == nil || !strings.Contains(err.Error(), "404") || report != nil {
+		t.Errorf("missing object = %v, %v, want the 404", report, err)
+	}
+	report, err = ByURL(context.Background(), "", 10, ts.URL+"/object", "", opts)
+	if err == nil || !strings.Contains(err.Error(), "503") || report != nil {
+		t.Errorf("failing download = %v, %v, want the 503", report, err)
+	}
+}
@@ -1,12 +1,17 @@
 package speedtest
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"io"
 	"math"
 	"math/rand"
 	"net"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -22,36 +27,31 @@ func init() {
 	rand.Seed(time.Now().Unix())
 }
 
-func getHttpUtil(interfaceOption string, timeout int) (*httpUtil, error) {
+func getHttpUtil(interfaceOption string, timeout int, opts *Options) (*httpUtil, error) {
 	util := &httpUtil{}
 	httpTimeout := time.Duration(timeout) * time.Second
 
-	dialer := net.Dialer{
-		Timeout:   httpTimeout,
-		KeepAlive: httpTimeout,
-	}
-
-	sourceIP, err := getSourceIP(interfaceOption)
+	dialer, err := getDialer(interfaceOption, timeout, opts)
 	if err != nil {
 		return nil, err
 	}
-	if sourceIP != "" {
-		if sourceIP == interfaceOption {
-			util.Interface.InternalIp = sourceIP
+	if dialer.sourceIP != "" {
+		if dialer.sourceIP == interfaceOption {
+			util.Interface.InternalIp = dialer.sourceIP
 		} else {
-			util.Interface.InternalIp = sourceIP
+			util.Interface.InternalIp = dialer.sourceIP
 			util.Interface.Name = interfaceOption
 		}
-		bindAddrIP, err := net.ResolveIPAddr("ip", sourceIP)
-		if err != nil {
-			return nil, err
-		}
-		dialer.LocalAddr = &net.TCPAddr{IP: bindAddrIP.IP}
 	}
 	transport := &http.Transport{
-		Proxy:               http.ProxyFromEnvironment,
-		Dial:                dialer.Dial,
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return dialer.dial(ctx, addr)
+		},
 		TLSHandshakeTimeout: httpTimeout,
+		MaxConnsPerHost:     opts.maxConnsPerHost(),
+		MaxIdleConnsPerHost: opts.maxIdleConnsPerHost(),
+		DisableKeepAlives:   opts.freshConnections(),
 	}
 	client := &http.Client{
 		Timeout:   httpTimeout,
@@ -61,12 +61,192 @@ func getHttpUtil(interfaceOption string, timeout int) (*httpUtil, error) {
 	return util, nil
 }
 
-func getSourceIP(interfaceOption string) (string, error) {
+// boundDialer opens TCP connections from the address of an interface
+type boundDialer struct {
+	net.Dialer
+	// tcp, or tcp4 / tcp6 when the family is fixed by the source address or Options.Family
+	network  string
+	sourceIP string
+	// interface the sockets are bound to on linux
+	device string
+	// network namespace the sockets are created in
+	netns string
+}
+
+func getDialer(interfaceOption string, timeout int, opts *Options) (*boundDialer, error) {
+	dialTimeout := time.Duration(timeout) * time.Second
+	dialer := &boundDialer{
+		Dialer: net.Dialer{
+			Timeout:   dialTimeout,
+			KeepAlive: dialTimeout,
+		},
+	}
+
+	family := opts.family()
+	dialer.netns = opts.netns()
+	var sourceIP string
+	// the interface is looked up among those of the namespace
+	err := inNetns(dialer.netns, func() (err error) {
+		sourceIP, err = getSourceIP(interfaceOption, family)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sourceIP != "" {
+		bindAddrIP, err := net.ResolveIPAddr("ip", sourceIP)
+		if err != nil {
+			return nil, err
+		}
+		dialer.LocalAddr = &net.TCPAddr{IP: bindAddrIP.IP, Zone: bindAddrIP.Zone}
+		dialer.sourceIP = sourceIP
+		// a bound socket can only reach servers of its own family
+		family = FamilyV4
+		if bindAddrIP.IP.To4() == nil {
+			family = FamilyV6
+		}
+	}
+	// the source address alone still follows the main routing table, an
+	// interface name also binds the socket to the device where that is possible
+	if sourceIP != "" && sourceIP != interfaceOption {
+		dialer.device = interfaceOption
+	}
+	dialer.Control = socketControl(dialer.device, opts.mark())
+	dialer.network = family.network()
+	if dialer.netns != "" {
+		// DNS queries leave from the namespace too. Like ip netns exec, the nameservers of
+		// /etc/netns/<name>/resolv.conf replace the host's when it exists, every new
+		// query connection takes the next one so that a retry moves on to another server
+		nameservers := netnsNameservers(dialer.netns)
+		var next uint32
+		dialer.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (conn net.Conn, err error) {
+				if len(nameservers) > 0 {
+					address = nameservers[(atomic.AddUint32(&next, 1)-1)%uint32(len(nameservers))]
+				}
+				err = inNetns(dialer.netns, func() (err error) {
+					conn, err = (&net.Dialer{Timeout: dialTimeout}).DialContext(ctx, network, address)
+					return err
+				})
+				return conn, err
+			},
+		}
+	}
+	return dialer, nil
+}
+
+func (d *boundDialer) dial(ctx context.Context, addr string) (net.Conn, error) {
+	if d.netns == "" {
+		return d.DialContext(ctx, d.network, addr)
+	}
+	// a host name is dialed by racing goroutines that may run on other threads,
+	// so it is resolved first and each address dialed in turn inside the namespace
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := d.Resolver.LookupIP(ctx, "ip"+strings.TrimPrefix(d.network, "tcp"), host)
+	if err != nil {
+		return nil, err
+	}
+	var conn net.Conn
+	for _, ip := range ips {
+		err = inNetns(d.netns, func() (err error) {
+			conn, err = d.DialContext(ctx, d.network, net.JoinHostPort(ip.String(), port))
+			return err
+		})
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+	}
+	return conn, err
+}
+
+// IPFamily selects the address family used to bind an interface and reach the servers
+type IPFamily int
+
+const (
+	// FamilyAny binds the first IPv4 address of an interface, or its first IPv6 one when it has none
+	FamilyAny IPFamily = iota
+	FamilyV4
+	FamilyV6
+)
+
+func (f IPFamily) String() string {
+	switch f {
+	case FamilyV4:
+		return "ipv4"
+	case FamilyV6:
+		return "ipv6"
+	}
+	return "any"
+}
+
+func (f IPFamily) network() string {
+	switch f {
+	case FamilyV4:
+		return "tcp4"
+	case FamilyV6:
+		return "tcp6"
+	}
+	return "tcp"
+}
+
+func (f IPFamily) match(ip net.IP) bool {
+	switch f {
+	case FamilyV4:
+		return ip.To4() != nil
+	case FamilyV6:
+		return ip.To4() == nil
+	}
+	return true
+}
+
+// the family a test runs on, from its source address or else the requested family
+func ipFamily(sourceIP string, family IPFamily) string {
+	if ip := net.ParseIP(sourceIP); ip != nil {
+		if ip.To4() != nil {
+			return FamilyV4.String()
+		}
+		return FamilyV6.String()
+	}
+	if family == FamilyAny {
+		return ""
+	}
+	return family.String()
+}
+
+// routeSourceIP is the address the default route of family leaves from, for packets
+// carrying mark when it is not 0 and in the namespace netns when it is set.
+// Connecting a UDP socket only looks the route up, nothing is sent
+func routeSourceIP(family IPFamily, mark uint32, netns string) (string, error) {
+	network, target := "udp4", "192.0.2.1:53"
+	if family == FamilyV6 {
+		network, target = "udp6", "[2001:db8::1]:53"
+	}
+	dialer := net.Dialer{Control: socketControl("", mark)}
+	var conn net.Conn
+	err := inNetns(netns, func() (err error) {
+		conn, err = dialer.Dial(network, target)
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("no %s route: %w", family, err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String(), nil
+}
+
+func getSourceIP(interfaceOption string, family IPFamily) (string, error) {
 	if interfaceOption == "" {
 		return "", nil
 	}
 	// does it look like an IP address?
-	if net.ParseIP(interfaceOption) != nil {
+	if ip := net.ParseIP(interfaceOption); ip != nil {
+		if !family.match(ip) {
+			return "", fmt.Errorf("%s is not an %s address", interfaceOption, family)
+		}
 		return interfaceOption, nil
 	}
 
@@ -81,18 +261,28 @@ func getSourceIP(interfaceOption string) (string, error) {
 		return "", err
 	}
 
+	var v6 string
 	for _, addr := range addrs {
+		var ip net.IP
 		switch v := addr.(type) {
 		case *net.IPNet:
-			// todo: IPv6
-			if v.IP.To4() != nil {
-				return v.IP.String(), nil
-			}
+			ip = v.IP
 		case *net.IPAddr:
-			if v.IP.To4() != nil {
-				return v.IP.String(), nil
-			}
+			ip = v.IP
+		}
+		if ip == nil || !family.match(ip) {
+			continue
 		}
+		if ip.To4() != nil {
+			return ip.String(), nil
+		}
+		// link-local addresses need a zone and can't reach a test server
+		if v6 == "" && !ip.IsLinkLocalUnicast() {
+			v6 = ip.String()
+		}
+	}
+	if v6 != "" {
+		return v6, nil
 	}
 	return "", errors.New("no address found")
 }
@@ -114,10 +304,96 @@ func calDistance(lat1 float64, lon1 float64, lat2 float64, lon2 float64) float64
 	return radius * math.Acos(x)
 }
 
-func randomNumStr(n int) string {
-	b := make([]byte, n)
+// randomPayload streams size pseudo random bytes, generated while they are
+// read so that large concurrent bodies keep memory flat and can't be compressed
+type randomPayload struct {
+	rnd       *rand.Rand
+	remaining int64
+}
+
+func newRandomPayload(size int64) *randomPayload {
+	return &randomPayload{
+		rnd:       rand.New(rand.NewSource(rand.Int63())),
+		remaining: size,
+	}
+}
+
+func (p *randomPayload) Read(b []byte) (int, error) {
+	if p.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(b)) > p.remaining {
+		b = b[:p.remaining]
+	}
+	n, _ := p.rnd.Read(b)
+	p.remaining -= int64(n)
+	return n, nil
+}
+
+// Len returns the bytes left to read, upload uses it as Content-Length
+func (p *randomPayload) Len() int {
+	return int(p.remaining)
+}
+
+const (
+	// speedtest.net upload.php servers get the form the legacy clients post
+	formContentType   = "application/x-www-form-urlencoded"
+	binaryContentType = "application/octet-stream"
+)
+
+// URL-safe characters a formPayload maps its random bytes to
+const formAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+
+// formPayload is the form field content= holding random characters, so that
+// upload.php reads valid form encoding. Like randomPayload it is generated
+// while it is read, six random bits per byte leave little to compress
+type formPayload struct {
+	field  string
+	random *randomPayload
+}
+
+// newFormPayload returns a form of size bytes, the field name included
+func newFormPayload(size int64) *formPayload {
+	field := "content="
+	if size < int64(len(field)) {
+		field = field[:size]
+	}
+	return &formPayload{field: field, random: newRandomPayload(size - int64(len(field)))}
+}
+
+func (p *formPayload) Read(b []byte) (int, error) {
+	if len(p.field) > 0 {
+		n := copy(b, p.field)
+		p.field = p.field[n:]
+		return n, nil
+	}
+	n, err := p.random.Read(b)
 	for i := 0; i < n; i++ {
-		b[i] = byte(rand.Int31())
+		b[i] = formAlphabet[b[i]&63]
 	}
-	return string(b)
+	return n, err
+}
+
+// Len returns the bytes left to read, upload uses it as Content-Length
+func (p *formPayload) Len() int {
+	return len(p.field) + p.random.Len()
+}
+
+// countingReader adds the bytes read through it to n
+type countingReader struct {
+	r     io.Reader
+	n     *int64
+	total int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(c.n, int64(n))
+	atomic.AddInt64(&c.total, int64(n))
+	return n, err
+}
+
+// Total returns the bytes read through c alone
+func (c *countingReader) Total() int64 {
+	return atomic.LoadInt64(&c.total)
 }
@@ -0,0 +1,379 @@
+package speedtest
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// the minimal RFC 6455 WebSocket support the ndt7 backend and handler need:
+// unfragmented writes, reassembled reads, ping / pong and the close handshake
+
+const (
+	wsText   = 0x1
+	wsBinary = 0x2
+	wsClose  = 0x8
+	wsPing   = 0x9
+	wsPong   = 0xa
+)
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// largest message read, bigger ones fail the connection
+const wsMaxMessage = 1 << 24
+
+type wsConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+	// clients mask what they send, servers don't
+	client bool
+
+	wmu    sync.Mutex
+	closed bool
+}
+
+// dialWebSocket opens a ws:// or wss:// connection through dialer asking for subprotocol
+func dialWebSocket(ctx context.Context, dialer *boundDialer, rawURL, subprotocol string) (*wsConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	switch u.Scheme {
+	case "ws":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+	case "wss":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported websocket scheme %q", u.Scheme)
+	}
+	conn, err := dialer.dial(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	// the handshake is bound to ctx, the connection itself is not
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+	if u.Scheme == "wss" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	keyBytes := make([]byte, 16)
+	rand.Read(keyBytes)
+	key := base64.StdEncoding.EncodeToString(keyBytes)
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        u,
+		Host:       u.Host,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if subprotocol != "" {
+		req.Header.Set("Sec-WebSocket-Protocol", subprotocol)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, fmt.Errorf("websocket handshake with %s: %s", u.Host, resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != wsAccept(key) {
+		conn.Close()
+		return nil, errors.New("websocket handshake: bad Sec-WebSocket-Accept")
+	}
+	if ctx.Err() != nil {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	return &wsConn{conn: conn, br: br, client: true}, nil
+}
+
+// acceptWebSocket upgrades r, the client must offer subprotocol when it is not empty
+func acceptWebSocket(w http.ResponseWriter, r *http.Request, subprotocol string) (*wsConn, error) {
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "websocket upgrade required", http.StatusBadRequest)
+		return nil, errors.New("not a websocket upgrade")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("unsupported websocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errors.New("missing Sec-WebSocket-Key")
+	}
+	if subprotocol != "" && !headerContains(r.Header, "Sec-WebSocket-Protocol", subprotocol) {
+		http.Error(w, "unsupported websocket subprotocol", http.StatusBadRequest)
+		return nil, errors.New("unsupported websocket subprotocol")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return nil, errors.New("response writer can't be hijacked")
+	}
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAccept(key) + "\r\n"
+	if subprotocol != "" {
+		response += "Sec-WebSocket-Protocol: " + subprotocol + "\r\n"
+	}
+	if _, err := io.WriteString(conn, response+"\r\n"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, br: brw.Reader}, nil
+}
+
+func wsAccept(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, value := range h[http.CanonicalHeaderKey(name)] {
+		for _, item := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(item), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeMessage sends payload as one unfragmented frame
+func (c *wsConn) writeMessage(opcode byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	if opcode == wsClose {
+		c.closed = true
+	}
+	header := make([]byte, 2, 14)
+	header[0] = 0x80 | opcode
+	length := len(payload)
+	switch {
+	case length < 126:
+		header[1] = byte(length)
+	case length <= 0xffff:
+		header[1] = 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+	default:
+		header[1] = 127
+		header = append(header, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+	if c.client {
+		header[1] |= 0x80
+		var mask [4]byte
+		rand.Read(mask[:])
+		header = append(header, mask[:]...)
+		masked := make([]byte, length)
+		for i := range payload {
+			masked[i] = payload[i] ^ mask[i%4]
+		}
+		payload = masked
+	}
+	if _, err := c.conn.Write(header); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(payload)
+	return err
+}
+
+// readMessage returns the next text message. Binary messages are copied to
+// binarySink and returned with a nil payload, pings are answered on the way.
+// A close frame is answered and reported as io.EOF
+func (c *wsConn) readMessage(binarySink io.Writer) (opcode byte, text []byte, err error) {
+	var message []byte
+	messageOpcode := byte(0)
+	size := 0
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch op {
+		case wsPing:
+			if err := c.writeMessage(wsPong, payload.bytes()); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case wsPong:
+			payload.discard()
+			continue
+		case wsClose:
+			body := payload.bytes()
+			c.writeMessage(wsClose, body)
+			return wsClose, nil, io.EOF
+		case wsText, wsBinary:
+			if messageOpcode != 0 {
+				return 0, nil, errors.New("websocket: new message inside a fragmented one")
+			}
+			messageOpcode = op
+		case 0:
+			if messageOpcode == 0 {
+				return 0, nil, errors.New("websocket: continuation without a message")
+			}
+		default:
+			return 0, nil, fmt.Errorf("websocket: unknown opcode %d", op)
+		}
+		size += int(payload.length)
+		if size > wsMaxMessage {
+			return 0, nil, errors.New("websocket: message too big")
+		}
+		if messageOpcode == wsBinary && binarySink != nil {
+			if _, err := io.Copy(binarySink, payload); err != nil {
+				return 0, nil, err
+			}
+		} else {
+			message = append(message, payload.bytes()...)
+		}
+		if payload.err != nil {
+			return 0, nil, payload.err
+		}
+		if fin {
+			if messageOpcode == wsBinary && binarySink != nil {
+				return wsBinary, nil, nil
+			}
+			return messageOpcode, message, nil
+		}
+	}
+}
+
+// wsPayload streams the payload of one frame, unmasking it when needed
+type wsPayload struct {
+	r      io.Reader
+	length int64
+	mask   []byte
+	pos    int
+	err    error
+}
+
+func (p *wsPayload) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	for i := 0; i < n && p.mask != nil; i++ {
+		b[i] ^= p.mask[p.pos%4]
+		p.pos++
+	}
+	if err != nil && err != io.EOF {
+		p.err = err
+	}
+	return n, err
+}
+
+func (p *wsPayload) bytes() []byte {
+	b, err := ioutil.ReadAll(p)
+	if err != nil {
+		p.err = err
+	}
+	return b
+}
+
+func (p *wsPayload) discard() {
+	io.Copy(ioutil.Discard, p)
+}
+
+func (c *wsConn) readFrame() (fin bool, opcode byte, payload *wsPayload, err error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.br, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+	length := int64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = int64(binary.BigEndian.Uint64(ext[:]) & (1<<63 - 1))
+	}
+	if length > wsMaxMessage {
+		return false, 0, nil, errors.New("websocket: frame too big")
+	}
+	// RFC 6455 section 5.1: a server closes the connection on an unmasked frame,
+	// a client on a masked one
+	if masked != !c.client {
+		c.writeMessage(wsClose, []byte{0x03, 0xea}) // 1002 protocol error
+		c.conn.Close()
+		if masked {
+			return false, 0, nil, errors.New("websocket: masked frame from the server")
+		}
+		return false, 0, nil, errors.New("websocket: unmasked frame from the client")
+	}
+	payload = &wsPayload{r: io.LimitReader(c.br, length), length: length}
+	if masked {
+		payload.mask = make([]byte, 4)
+		if _, err := io.ReadFull(c.br, payload.mask); err != nil {
+			return false, 0, nil, err
+		}
+	}
+	return fin, opcode, payload, nil
+}
+
+// close starts the close handshake, the peer's answer is read by readMessage
+func (c *wsConn) close() error {
+	return c.writeMessage(wsClose, []byte{0x03, 0xe8}) // 1000 normal closure
+}
@@ -0,0 +1,145 @@
+package speedtest
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wsTestServer accepts WebSockets with handle, the error of each handled connection is sent on the channel
+func wsTestServer(t *testing.T, handle func(*wsConn) error) (string, chan error) {
+	errs := make(chan error, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := acceptWebSocket(w, r, "test")
+		if err != nil {
+			errs <- err
+			return
+		}
+		defer conn.conn.Close()
+		errs <- handle(conn)
+	}))
+	t.Cleanup(ts.Close)
+	return "ws" + strings.TrimPrefix(ts.URL, "http"), errs
+}
+
+func wsTestDial(t *testing.T, rawURL string) *wsConn {
+	dialer, err := getDialer("", 5, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialWebSocket(context.Background(), dialer, rawURL, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.conn.Close() })
+	conn.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func TestWebSocketEcho(t *testing.T) {
+	url, errs := wsTestServer(t, func(conn *wsConn) error {
+		for {
+			var binary bytes.Buffer
+			opcode, text, err := conn.readMessage(&binary)
+			if err != nil {
+				return err
+			}
+			if opcode == wsBinary {
+				text = binary.Bytes()
+			}
+			if err := conn.writeMessage(opcode, text); err != nil {
+				return err
+			}
+		}
+	})
+	conn := wsTestDial(t, url)
+
+	// the ping is answered with a pong readMessage skips
+	if err := conn.writeMessage(wsPing, []byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.writeMessage(wsText, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	opcode, text, err := conn.readMessage(nil)
+	if err != nil || opcode != wsText || string(text) != "hello" {
+		t.Fatalf("echo = %d %q %v, want the text message", opcode, text, err)
+	}
+
+	// 70000 bytes need the 64 bit length
+	payload := bytes.Repeat([]byte("0123456789"), 7000)
+	if err := conn.writeMessage(wsBinary, payload); err != nil {
+		t.Fatal(err)
+	}
+	var sink bytes.Buffer
+	opcode, text, err = conn.readMessage(&sink)
+	if err != nil || opcode != wsBinary || text != nil || !bytes.Equal(sink.Bytes(), payload) {
+		t.Fatalf("echo = %d, %d bytes in the sink, %v, want the binary message", opcode, sink.Len(), err)
+	}
+
+	if err := conn.close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := conn.readMessage(nil); err != io.EOF {
+		t.Errorf("read after close = %v, want io.EOF", err)
+	}
+	if err := <-errs; err != io.EOF {
+		t.Errorf("server = %v, want io.EOF", err)
+	}
+}
+
+// RFC 6455 section 5.1: the server fails the connection on an unmasked frame
+func TestWebSocketUnmaskedClientFrame(t *testing.T) {
+	url, errs := wsTestServer(t, func(conn *wsConn) error {
+		_, _, err := conn.readMessage(ioutil.Discard)
+		return err
+	})
+	conn := wsTestDial(t, url)
+	// written like a server would, without a mask
+	conn.client = false
+	if err := conn.writeMessage(wsText, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	conn.client = true
+	_, opcode, payload, err := conn.readFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := payload.bytes(); opcode != wsClose || !bytes.Equal(code, []byte{0x03, 0xea}) {
+		t.Errorf("server sent %d %x, want a close with 1002", opcode, code)
+	}
+	if _, _, _, err := conn.readFrame(); err == nil {
+		t.Error("connection still open after the protocol error")
+	}
+	if err := <-errs; err == nil || !strings.Contains(err.Error(), "unmasked") {
+		t.Errorf("server = %v, want the unmasked frame error", err)
+	}
+}
+
+func TestWebSocketHandshake(t *testing.T) {
+	url, errs := wsTestServer(t, func(conn *wsConn) error { return nil })
+	dialer, err := getDialer("", 5, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dialWebSocket(context.Background(), dialer, url, "other"); err == nil {
+		t.Error("handshake accepted without the subprotocol")
+	}
+	if err := <-errs; err == nil {
+		t.Error("server accepted an unknown subprotocol")
+	}
+	resp, err := http.Get("http" + strings.TrimPrefix(url, "ws"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("plain GET = %s, want 400", resp.Status)
+	}
+}